@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/RocketChat/Rocket.Chat.Go.SDK/models"
+)
+
+const defaultMaxConcurrentSends = 10
+
+// loginCall is a login in progress, shared by the requests waiting for it
+type loginCall struct {
+	done chan struct{}
+	user *models.User
+	err  error
+}
+
+// sharedClient guards the connector shared by the concurrent webhook
+// requests. Concurrent logins are merged into a single one, which runs alone,
+// and the number of concurrent calls is bounded.
+type sharedClient struct {
+	RocketChat
+
+	mutex sync.RWMutex
+	slots chan struct{}
+
+	loginMutex sync.Mutex
+	login      *loginCall
+
+	// reconnecting is set while the realtime client reconnects
+	reconnecting int32
+}
+
+func newSharedClient(connector RocketChat, maxConcurrentSends int) *sharedClient {
+	return &sharedClient{
+		RocketChat: connector,
+		slots:      make(chan struct{}, maxConcurrentSends),
+	}
+}
+
+// call runs f alongside the other calls, once a slot is free
+func (client *sharedClient) call(f func()) {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+
+	client.slots <- struct{}{}
+	defer func() { <-client.slots }()
+	f()
+}
+
+// exclusive runs f once every other call returned
+func (client *sharedClient) exclusive(f func()) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	f()
+}
+
+// Login logs in, or waits for the login already in progress and returns its
+// outcome
+func (client *sharedClient) Login(credentials *models.UserCredentials) (*models.User, error) {
+	client.loginMutex.Lock()
+	if call := client.login; call != nil {
+		client.loginMutex.Unlock()
+		<-call.done
+		return call.user, call.err
+	}
+	call := &loginCall{done: make(chan struct{})}
+	client.login = call
+	client.loginMutex.Unlock()
+
+	client.exclusive(func() {
+		call.user, call.err = client.RocketChat.Login(credentials)
+	})
+
+	client.loginMutex.Lock()
+	client.login = nil
+	client.loginMutex.Unlock()
+	close(call.done)
+	return call.user, call.err
+}
+
+// GetChannelID returns the ID of the channel
+func (client *sharedClient) GetChannelID(channelName string) (channelID string, err error) {
+	client.call(func() {
+		channelID, err = client.RocketChat.GetChannelID(channelName)
+	})
+	return channelID, err
+}
+
+// GetDirectMessageRoomID returns the ID of the direct message room with the user
+func (client *sharedClient) GetDirectMessageRoomID(username string) (roomID string, err error) {
+	client.call(func() {
+		roomID, err = client.RocketChat.GetDirectMessageRoomID(username)
+	})
+	return roomID, err
+}
+
+// SendMessage posts the message
+func (client *sharedClient) SendMessage(message *models.Message) (sent *models.Message, err error) {
+	client.call(func() {
+		sent, err = client.RocketChat.SendMessage(message)
+	})
+	return sent, err
+}
+
+// EditMessage updates the message
+func (client *sharedClient) EditMessage(message *models.Message) (err error) {
+	client.call(func() {
+		err = client.RocketChat.EditMessage(message)
+	})
+	return err
+}
+
+// SendThreadMessage posts the message in a thread
+func (client *sharedClient) SendThreadMessage(message *ThreadMessage) (sent *models.Message, err error) {
+	client.call(func() {
+		sent, err = client.RocketChat.SendThreadMessage(message)
+	})
+	return sent, err
+}
+
+// realtimeConnector returns the realtime connector behind connector
+func realtimeConnector(connector RocketChat) (RocketChatConnector, bool) {
+	if client, ok := connector.(*sharedClient); ok {
+		connector = client.RocketChat
+	}
+	rtConnector, ok := connector.(RocketChatConnector)
+	return rtConnector, ok
+}
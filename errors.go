@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	codeBadPayload     = "bad_payload"
+	codeUnknownChannel = "unknown_channel"
+	codeRejected       = "rejected"
+	codeTemplate       = "template_error"
+	codeAuthentication = "authentication_failed"
+	codeUnavailable    = "rocketchat_unavailable"
+	codeQueueFull      = "queue_full"
+	codeUnknownProfile = "unknown_profile"
+)
+
+// ChannelResult is the outcome of the delivery of a notification to a
+// channel. Server is set for the channels of the named servers.
+type ChannelResult struct {
+	Channel   string
+	Server    string `json:",omitempty"`
+	Delivered bool
+	Code      string `json:",omitempty"`
+	Message   string `json:",omitempty"`
+}
+
+// newChannelResult returns the result of the delivery to channel failing with err
+func newChannelResult(channel string, err error) ChannelResult {
+	if err == nil {
+		return ChannelResult{Channel: channel, Delivered: true}
+	}
+	_, code := errorResponse(err)
+	return ChannelResult{Channel: channel, Code: code, Message: err.Error()}
+}
+
+// causer is implemented by the errors wrapping the error that explains them
+type causer interface {
+	cause() error
+}
+
+// rootCause returns the error explaining err
+func rootCause(err error) error {
+	for {
+		wrapper, ok := err.(causer)
+		if !ok {
+			return err
+		}
+		err = wrapper.cause()
+	}
+}
+
+// unknownChannelError is returned when the channel of an alert does not exist
+// or is not accessible to the user
+type unknownChannelError struct {
+	channel string
+	err     error
+}
+
+func (err *unknownChannelError) Error() string {
+	return fmt.Sprintf("unknown channel %s: %v", err.channel, err.err)
+}
+
+// templateError is returned when the message of an alert can't be formatted
+// with the configured templates, it is not sent again as it would fail again
+type templateError struct {
+	err error
+}
+
+func (err *templateError) Error() string {
+	return fmt.Sprintf("error formatting message: %v", err.err)
+}
+
+// notificationError is returned when a notification was not delivered to
+// every channel
+type notificationError struct {
+	results []ChannelResult
+	errs    []error
+}
+
+func (err *notificationError) Error() string {
+	messages := make([]string, 0, len(err.errs))
+	for _, result := range err.results {
+		if !result.Delivered && result.Server != "" {
+			messages = append(messages, fmt.Sprintf("channel %s on server %s: %s", result.Channel, result.Server, result.Message))
+		} else if !result.Delivered {
+			messages = append(messages, fmt.Sprintf("channel %s: %s", result.Channel, result.Message))
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// cause returns the error of the channel that is the most likely to be fixed
+// by another attempt: authentication errors first, then transient errors
+func (err *notificationError) cause() error {
+	rank := map[string]int{attemptAuthError: 0, attemptTransientError: 1, attemptPermanentError: 2}
+	cause := err.errs[0]
+	for _, channelErr := range err.errs[1:] {
+		if rank[classifyError(channelErr)] < rank[classifyError(cause)] {
+			cause = channelErr
+		}
+	}
+	return cause
+}
+
+// errorResponse returns the HTTP status and the error code answered to
+// AlertManager for err. AlertManager retries the notifications answered with
+// a 5xx status and drops the ones answered with a 4xx status.
+func errorResponse(err error) (int, string) {
+	if _, ok := rootCause(err).(*unknownChannelError); ok {
+		return http.StatusUnprocessableEntity, codeUnknownChannel
+	}
+	if _, ok := rootCause(err).(*templateError); ok {
+		return http.StatusUnprocessableEntity, codeTemplate
+	}
+	switch classifyError(err) {
+	case attemptAuthError:
+		return http.StatusBadGateway, codeAuthentication
+	case attemptPermanentError:
+		return http.StatusUnprocessableEntity, codeRejected
+	}
+	return http.StatusServiceUnavailable, codeUnavailable
+}
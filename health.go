@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopackage/ddp"
+)
+
+// ReadinessInfo - Readiness probe configuration
+type ReadinessInfo struct {
+	MaxSendAge   time.Duration `yaml:"max_send_age"`
+	ProbeChannel string        `yaml:"probe_channel"`
+}
+
+// healthState is what the webhook knows of its link with the Rocket.Chat servers
+type healthState struct {
+	mutex         sync.Mutex
+	authenticated map[string]bool
+	lastSuccess   time.Time
+	lastFailure   time.Time
+}
+
+var health = &healthState{authenticated: map[string]bool{}, lastSuccess: time.Now()}
+
+// recordLogin remembers whether the last login to the server succeeded
+func (state *healthState) recordLogin(server string, errLogin error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	state.authenticated[server] = errLogin == nil
+}
+
+// isAuthenticated returns whether the last login to the server succeeded
+func (state *healthState) isAuthenticated(server string) bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	return state.authenticated[server]
+}
+
+// forget drops what is known of a server removed by a reload
+func (state *healthState) forget(server string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	delete(state.authenticated, server)
+}
+
+// recordDelivery remembers when the last notification was delivered or could
+// not be. The notifications rejected by Rocket.Chat say nothing of its health.
+func (state *healthState) recordDelivery(errSend error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if errSend == nil {
+		state.lastSuccess = time.Now()
+	} else if classifyError(errSend) != attemptPermanentError {
+		state.lastFailure = time.Now()
+	}
+}
+
+// problems returns why the webhook can't deliver notifications. The problems
+// of the named servers are prefixed with their name.
+func (state *healthState) problems(servers []ServerInfo, maxSendAge time.Duration) []string {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	var problems []string
+	for _, server := range servers {
+		prefix := ""
+		if server.Name != defaultServerName {
+			prefix = fmt.Sprintf("server %s: ", server.Name)
+		}
+		if !state.authenticated[server.Name] {
+			problems = append(problems, prefix+"not authenticated")
+		}
+		if server.isRealtime() && trackedConnectionStatus(server.Name) != ddp.CONNECTED {
+			problems = append(problems, prefix+"websocket not connected")
+		}
+	}
+	if maxSendAge > 0 && state.lastFailure.After(state.lastSuccess) && time.Since(state.lastSuccess) > maxSendAge {
+		problems = append(problems, fmt.Sprintf("no notification delivered since %s", state.lastSuccess.Format(time.RFC3339)))
+	}
+	return problems
+}
+
+// checkReadiness returns why the webhook is not ready, probing the channel
+// if one is configured. The servers whose last login failed log in again
+// first, except the realtime ones that log in when they are reconnected.
+func checkReadiness() []string {
+	active, connector := activeConfig()
+	for _, server := range active.servers() {
+		if client := active.client(server.Name); client != nil && !server.isRealtime() && !health.isAuthenticated(server.Name) {
+			authenticateServerOrLog(server, client)
+		}
+	}
+	problems := health.problems(active.servers(), active.Readiness.MaxSendAge)
+	if active.Readiness.ProbeChannel != "" {
+		if _, errProbe := connector.GetChannelID(active.Readiness.ProbeChannel); errProbe != nil {
+			problems = append(problems, fmt.Sprintf("probe of channel %s failed: %v", active.Readiness.ProbeChannel, errProbe))
+		}
+	}
+	return problems
+}
+
+// healthy answers as long as the process is up
+func healthy(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponse(w, http.StatusOK, "Healthy")
+}
+
+// ready answers whether the webhook can deliver notifications to Rocket.Chat
+func ready(w http.ResponseWriter, r *http.Request) {
+	if problems := checkReadiness(); len(problems) > 0 {
+		sendJSONResponse(w, http.StatusServiceUnavailable, strings.Join(problems, "; "))
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, "Ready")
+}
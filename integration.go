@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/RocketChat/Rocket.Chat.Go.SDK/models"
+)
+
+var errIntegrationUnsupported = errors.New("not supported by the integration transport")
+
+// IntegrationConnector is the RocketChat client posting to incoming WebHook
+// integrations, it needs no Rocket.Chat user
+type IntegrationConnector struct {
+	URLs   map[string]string
+	Client *http.Client
+}
+
+// NewIntegrationConnector returns a client posting to the integration URL of
+// each channel with the given timeout
+func NewIntegrationConnector(urls map[string]string, timeout time.Duration) *IntegrationConnector {
+	return &IntegrationConnector{
+		URLs:   urls,
+		Client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Login does nothing, integrations are authenticated by the token of their URL
+func (connector *IntegrationConnector) Login(credentials *models.UserCredentials) (*models.User, error) {
+	return &models.User{}, nil
+}
+
+// GetChannelID returns the channel name itself, which selects the integration
+// URL when sending the message
+func (connector *IntegrationConnector) GetChannelID(channelName string) (string, error) {
+	if _, exists := connector.URLs[channelName]; !exists {
+		return "", &unknownChannelError{channel: channelName, err: errors.New("no integration configured")}
+	}
+	return channelName, nil
+}
+
+// GetDirectMessageRoomID returns the destination of the user, whose
+// integration is configured for @username
+func (connector *IntegrationConnector) GetDirectMessageRoomID(username string) (string, error) {
+	return connector.GetChannelID(directMessagePrefix + username)
+}
+
+// SendMessage posts the message to the integration of its channel
+func (connector *IntegrationConnector) SendMessage(message *models.Message) (*models.Message, error) {
+	integrationURL, exists := connector.URLs[message.RoomID]
+	if !exists {
+		return nil, fmt.Errorf("no integration configured for channel %s", message.RoomID)
+	}
+
+	postMessage := message.PostMessage
+	postMessage.Text = message.Msg
+
+	errPost := jsonCall(connector.Client, http.MethodPost, integrationURL, "integration "+message.RoomID, nil, postMessage, nil)
+	if errPost != nil {
+		return nil, errPost
+	}
+	return message, nil
+}
+
+// EditMessage is not supported, integrations can only post messages
+func (connector *IntegrationConnector) EditMessage(message *models.Message) error {
+	return errIntegrationUnsupported
+}
+
+// SendThreadMessage is not supported, integrations can only post messages
+func (connector *IntegrationConnector) SendThreadMessage(message *ThreadMessage) (*models.Message, error) {
+	return nil, errIntegrationUnsupported
+}
+
+// NewMessage creates a message for the channel
+func (connector *IntegrationConnector) NewMessage(channel *models.Channel, text string) *models.Message {
+	return &models.Message{
+		RoomID: channel.ID,
+		Msg:    text,
+	}
+}
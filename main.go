@@ -4,12 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/RocketChat/Rocket.Chat.Go.SDK/models"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/alertmanager/template"
@@ -25,93 +25,330 @@ var (
 	rocketChat    RocketChat
 )
 
-// JSONResponse is the webhook http response
+// JSONResponse is the webhook http response. Code identifies the error and
+// Channels lists the result of the delivery to each channel.
 type JSONResponse struct {
-	Status  int
-	Message string
+	Status   int
+	Message  string
+	Code     string          `json:",omitempty"`
+	Channels []ChannelResult `json:",omitempty"`
 }
 
 // Config - Rocket.Chat webhook configuration
 type Config struct {
-	Endpoint       url.URL                `yaml:"endpoint"`
-	Credentials    models.UserCredentials `yaml:"credentials"`
-	SeverityColors map[string]string      `yaml:"severity_colors"`
-	Channel        ChannelInfo            `yaml:"channel"`
+	Endpoint           url.URL                 `yaml:"endpoint"`
+	Transport          string                  `yaml:"transport"`
+	Timeout            time.Duration           `yaml:"timeout"`
+	Credentials        CredentialsInfo         `yaml:"credentials"`
+	SeverityColors     map[string]string       `yaml:"severity_colors"`
+	Channel            ChannelInfo             `yaml:"channel"`
+	Templates          TemplatesInfo           `yaml:"templates"`
+	Routes             []Route                 `yaml:"routes"`
+	GroupingMode       string                  `yaml:"grouping_mode"`
+	MaxAttachments     int                     `yaml:"max_attachments"`
+	UpdateMode         string                  `yaml:"update_mode"`
+	State              StateInfo               `yaml:"state"`
+	Integrations       map[string]string       `yaml:"integrations"`
+	Message            MessageInfo             `yaml:"message"`
+	Queue              QueueInfo               `yaml:"queue"`
+	Spool              SpoolInfo               `yaml:"spool"`
+	Retry              RetryInfo               `yaml:"retry"`
+	Readiness          ReadinessInfo           `yaml:"readiness"`
+	Realtime           RealtimeInfo            `yaml:"realtime"`
+	MaxConcurrentSends int                     `yaml:"max_concurrent_sends"`
+	Servers            []ServerInfo            `yaml:"servers"`
+	Profiles           map[string]ProfileInfo  `yaml:"profiles"`
+	Receivers          map[string]ReceiverInfo `yaml:"receivers"`
+	Mentions           MentionsInfo            `yaml:"mentions"`
+
+	// profileServer is the server of the alerts not routed to a server, set
+	// by the profile of the notification
+	profileServer string
+	// clients are the clients of the servers when the configuration is a
+	// snapshot of the active one
+	clients map[string]RocketChat
+}
+
+// MessageInfo - Message appearance configuration
+type MessageInfo struct {
+	Alias  string `yaml:"alias"`
+	Emoji  string `yaml:"emoji"`
+	Avatar string `yaml:"avatar"`
+}
+
+// maxAttachments returns the maximum number of alert attachments of a grouped message
+func (config Config) maxAttachments() int {
+	if config.MaxAttachments > 0 {
+		return config.MaxAttachments
+	}
+	return defaultMaxAttachments
 }
 
 // ChannelInfo - Channel configuration
 type ChannelInfo struct {
 	DefaultChannelName string `yaml:"default_channel_name"`
+	LabelName          string `yaml:"label_name"`
 }
 
-func checkConfig(config Config) error {
-	if config.Credentials.Name == "" {
-		return errors.New("rocket.chat name not provided")
+// labelName returns the name of the alert label holding the channel name
+func (channel ChannelInfo) labelName() string {
+	if channel.LabelName != "" {
+		return channel.LabelName
+	}
+	return defaultChannelLabel
+}
+
+func checkConfig(config *Config) error {
+	if err := checkServer(config.defaultServer()); err != nil {
+		return err
+	}
+	if err := checkServers(config); err != nil {
+		return err
+	}
+	if config.GroupingMode != "" && config.GroupingMode != groupingPerAlert && config.GroupingMode != groupingPerNotification {
+		return fmt.Errorf("unknown grouping mode %q", config.GroupingMode)
+	}
+	switch config.UpdateMode {
+	case "", updateModeNewMessage:
+	case updateModeEdit, updateModeThread:
+		if config.GroupingMode == groupingPerNotification {
+			return fmt.Errorf("update mode %q requires grouping mode %q", config.UpdateMode, groupingPerAlert)
+		}
+		for _, server := range config.servers() {
+			if server.Transport == transportIntegration {
+				return fmt.Errorf("update mode %q is not supported by transport %q", config.UpdateMode, server.Transport)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown update mode %q", config.UpdateMode)
+	}
+	switch config.State.Backend {
+	case "", stateBackendMemory:
+	case stateBackendFile:
+		if config.State.Path == "" {
+			return errors.New("state file path not provided")
+		}
+	default:
+		return fmt.Errorf("unknown state backend %q", config.State.Backend)
+	}
+	if config.Queue.Size < 0 || config.Queue.Workers < 0 {
+		return errors.New("queue size and workers must be positive")
+	}
+	if err := checkRetry(config.Retry); err != nil {
+		return err
+	}
+	if config.Realtime.KeepaliveInterval < 0 || config.Realtime.MaxReconnectFailures < 0 {
+		return errors.New("realtime keepalive interval and max reconnect failures must be positive")
+	}
+	if config.Readiness.MaxSendAge < 0 {
+		return errors.New("readiness max send age must be positive")
+	}
+	if config.MaxConcurrentSends < 0 {
+		return errors.New("max concurrent sends must be positive")
+	}
+	if config.MaxAttachments < 0 {
+		return errors.New("max attachments must be positive")
 	}
-	if config.Credentials.Email == "" {
-		return errors.New("rocket.chat email not provided")
+	if err := loadRoutes(config.Routes); err != nil {
+		return err
 	}
-	if config.Credentials.Password == "" {
-		return errors.New("rocket.chat password not provided")
+	if err := loadTemplates(&config.Templates); err != nil {
+		return err
 	}
-	if config.Endpoint.Host == "" {
+	if err := loadMentions(&config.Mentions); err != nil {
+		return err
+	}
+	if err := checkProfiles(config); err != nil {
+		return err
+	}
+	return checkReceivers(config)
+}
+
+// checkCredentials checks the Rocket.Chat server and user are provided. The
+// user authenticates either with a personal access token and its user ID, or
+// with its email and password.
+func checkCredentials(server ServerInfo) error {
+	if server.Credentials.Token != "" {
+		if server.Credentials.ID == "" {
+			return errors.New("rocket.chat user id not provided")
+		}
+	} else {
+		if server.Credentials.Name == "" {
+			return errors.New("rocket.chat name not provided")
+		}
+		if server.Credentials.Email == "" {
+			return errors.New("rocket.chat email not provided")
+		}
+		if server.Credentials.Password == "" {
+			return errors.New("rocket.chat password not provided")
+		}
+	}
+	if server.Endpoint.Host == "" {
 		return errors.New("rocket.chat host not provided")
 	}
-	if config.Endpoint.Scheme == "" {
+	if server.Endpoint.Scheme == "" {
 		return errors.New("rocket.chat scheme not provided")
 	}
 	return nil
 }
 
+// checkIntegrations checks the integration URLs are valid
+func checkIntegrations(server ServerInfo) error {
+	if len(server.Integrations) == 0 {
+		return errors.New("rocket.chat integrations not provided")
+	}
+	for channelName, integrationURL := range server.Integrations {
+		parsedURL, err := url.Parse(integrationURL)
+		if err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
+			return fmt.Errorf("invalid integration URL for channel %s", channelName)
+		}
+	}
+	return nil
+}
+
 func webhook(w http.ResponseWriter, r *http.Request) {
+	profile := webhookProfile(r)
+	if !hasProfile(profile) {
+		writeJSONResponse(w, JSONResponse{Status: http.StatusNotFound, Message: fmt.Sprintf("unknown profile %s", profile), Code: codeUnknownProfile})
+		return
+	}
+
 	data, err := readRequestBody(r)
 	if err != nil {
-		sendJSONResponse(w, http.StatusBadRequest, err.Error())
+		writeJSONResponse(w, JSONResponse{Status: http.StatusBadRequest, Message: err.Error(), Code: codeBadPayload})
 		return
 	}
 
-	var errAuthentication error
-
-	errSend := retry(1, 2*time.Second, func() (err error) {
-		errSend := SendNotification(rocketChat, data)
-		if errSend != nil {
-			errAuthentication = AuthenticateRocketChatClient(rocketChat)
-		}
+	receivedNotifications.WithLabelValues(data.Status, data.Receiver).Inc()
+	for _, alert := range data.Alerts {
+		receivedAlerts.WithLabelValues(alert.Status, data.Receiver).Inc()
+	}
 
-		if errAuthentication != nil {
-			log.Errorf("Error authenticating RocketChat client: %v", errAuthentication)
+	if notificationQueue != nil {
+		if !notificationQueue.enqueue(profile, data) {
+			writeJSONResponse(w, JSONResponse{Status: http.StatusServiceUnavailable, Message: "Queue full", Code: codeQueueFull})
+			return
 		}
+		// Returns a 202 once the notification is queued
+		sendJSONResponse(w, http.StatusAccepted, "Accepted")
+		return
+	}
 
-		return errSend
-
-	})
-
-	if errSend != nil {
+	results, undelivered, errSend := deliver(profile, data, nil)
+	if errSend != nil && spoolOrLog(profile, data, undelivered, errSend) {
+		// Returns a 202 if the notification will be delivered later
+		writeJSONResponse(w, JSONResponse{Status: http.StatusAccepted, Message: "Spooled", Channels: results})
+	} else if errSend != nil {
 		log.Errorf("Error sending notifications to RocketChat : %v", errSend)
-		// Returns a 403 if the user can't authenticate
-		sendJSONResponse(w, http.StatusUnauthorized, errAuthentication.Error())
+		// Returns a 4xx if Rocket.Chat rejected the notification, a 5xx if
+		// AlertManager should send it again
+		status, code := errorResponse(errSend)
+		writeJSONResponse(w, JSONResponse{Status: status, Message: errSend.Error(), Code: code, Channels: results})
 	} else {
 		// Returns a 200 if everything went smoothly
-		sendJSONResponse(w, http.StatusOK, "Success")
+		writeJSONResponse(w, JSONResponse{Status: http.StatusOK, Message: "Success", Channels: results})
 	}
 }
 
-func retry(retries int, sleep time.Duration, f func() error) (err error) {
-	for i := 0; ; i++ {
-		err = f()
-		if err == nil {
-			return nil
+// deliver sends the notification with the settings of the profile to
+// Rocket.Chat, retrying on failure as configured and authenticating again
+// after an authentication error. Only the batches of alerts that were not
+// delivered are sent again. batches are the batches left to deliver, nil to
+// route the whole notification. It returns the result of the delivery to each
+// channel and the batches that could not be delivered.
+func deliver(profile string, data template.Data, batches []*channelBatch) (results []ChannelResult, undelivered []*channelBatch, errSend error) {
+	// Each attempt uses the configuration and the clients active when it
+	// starts, so that a reload is not held up by the notifications being sent
+	active, connector := activeConfig()
+	undelivered = batches
+	routed := batches != nil
+
+	errSend = retry(active.Retry, func(previous string) (err error) {
+		if previous != attemptSuccess {
+			active, connector = activeConfig()
+		}
+		settings, exists := active.withProfile(profile)
+		if !exists {
+			log.Warnf("Profile %s not configured anymore, sending with the top level settings", profile)
+		}
+		settings = settings.withReceiver(data.Receiver)
+		if !routed {
+			undelivered = settings.batchAlerts(data)
+			routed = true
 		}
 
-		if i >= retries {
-			break
+		if previous == attemptAuthError {
+			active.reauthenticate(results)
 		}
+		var attempt []ChannelResult
+		attempt, err = settings.sendBatches(connector, undelivered, data)
+		results = mergeResults(results, attempt)
+		undelivered = undeliveredBatches(undelivered, attempt)
+		return err
+	})
+	health.recordDelivery(errSend)
+
+	return results, undelivered, errSend
+}
 
-		time.Sleep(sleep)
+// mergeResults replaces the results of the channels sent again by the ones
+// of the last attempt
+func mergeResults(results, attempt []ChannelResult) []ChannelResult {
+	if results == nil {
+		return attempt
+	}
+	merged := append([]ChannelResult{}, results...)
+	for _, result := range attempt {
+		for i := range merged {
+			if merged[i].Channel == result.Channel && merged[i].Server == result.Server {
+				merged[i] = result
+			}
+		}
+	}
+	return merged
+}
 
-		log.Warnf("retrying after error: %v", err)
+// undeliveredBatches returns the batches whose result is not delivered, the
+// results being in the order of the batches
+func undeliveredBatches(batches []*channelBatch, results []ChannelResult) []*channelBatch {
+	var undelivered []*channelBatch
+	for i, batch := range batches {
+		if i < len(results) && !results[i].Delivered {
+			undelivered = append(undelivered, batch)
+		}
 	}
-	return fmt.Errorf("after %d retries, last error: %s", retries, err)
+	return undelivered
+}
+
+// reauthenticate logs in again to the servers of the channels whose delivery
+// failed with an authentication error
+func (config Config) reauthenticate(results []ChannelResult) {
+	servers := map[string]bool{}
+	for _, result := range results {
+		if result.Code != codeAuthentication {
+			continue
+		}
+		name := result.Server
+		if name == "" {
+			name = defaultServerName
+		}
+		if servers[name] {
+			continue
+		}
+		servers[name] = true
+		if server, exists := config.server(name); exists && config.client(name) != nil {
+			authenticateServerOrLog(server, config.client(name))
+		}
+	}
+}
+
+// retryAfter returns the delay AlertManager is asked to wait before sending
+// again a notification that could not be delivered
+func retryAfter() time.Duration {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	return config.Retry.maxBackoff()
 }
 
 // Starts 2 listeners
@@ -122,9 +359,13 @@ func main() {
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 
-	config = loadConfig(*configFile)
+	var errConfig error
+	config, errConfig = loadConfig(*configFile)
+	if errConfig != nil {
+		log.Fatalf("Error: %v", errConfig)
+	}
 
-	errCheckConfig := checkConfig(config)
+	errCheckConfig := checkConfig(&config)
 	if errCheckConfig != nil {
 		log.Fatalf("Missing Rocket.Chat config parameters:%v", errCheckConfig)
 	} else {
@@ -134,13 +375,45 @@ func main() {
 			log.Fatalf("Error getting RocketChat client: %v", errClient)
 		}
 
+		var errState error
+		alertMessages, errState = newStateStore(config.State)
+		if errState != nil {
+			log.Fatalf("Error opening state store: %v", errState)
+		}
+		go runStateGC(alertMessages, config.State.gcInterval())
+
 		errAuthentication := AuthenticateRocketChatClient(rocketChat)
 		if errAuthentication != nil {
 			log.Errorf("Error authenticating RocketChat client: %v", errAuthentication)
 		}
+		if errServers := connectServers(); errServers != nil {
+			log.Fatalf("Error getting RocketChat client: %v", errServers)
+		}
+		go superviseRealtime(config.Realtime.keepaliveInterval(), nil)
+		if config.Spool.Directory != "" {
+			var errSpool error
+			notificationSpool, errSpool = newSpool(config.Spool.Directory, config.Spool.maxAge())
+			if errSpool != nil {
+				log.Fatalf("Error opening spool: %v", errSpool)
+			}
+			go notificationSpool.run(config.Spool.interval())
+		}
+		if config.Queue.Enabled {
+			notificationQueue = newQueue(config.Queue.size())
+			notificationQueue.start(config.Queue.workers())
+		}
+
+		setConfigReloadSuccess(true)
+		go reloadOnSIGHUP(*configFile)
+
 		log.Info("Starting webhook", version.Info())
 		log.Info("Build context", version.BuildContext())
-		http.HandleFunc("/webhook", webhook)
+		webhookHandler := promhttp.InstrumentHandlerDuration(webhookDuration, http.HandlerFunc(webhook))
+		http.Handle(webhookPath, webhookHandler)
+		http.Handle(webhookPathPrefix, webhookHandler)
+		http.HandleFunc("/-/reload", reload)
+		http.HandleFunc("/-/healthy", healthy)
+		http.HandleFunc("/-/ready", ready)
 		http.Handle("/metrics", promhttp.Handler())
 
 		log.Infof("listening on: %v", *listenAddress)
@@ -149,12 +422,17 @@ func main() {
 }
 
 func sendJSONResponse(w http.ResponseWriter, status int, message string) {
-	data := JSONResponse{
+	writeJSONResponse(w, JSONResponse{
 		Status:  status,
 		Message: message,
-	}
+	})
+}
 
-	w.WriteHeader(status)
+func writeJSONResponse(w http.ResponseWriter, data JSONResponse) {
+	if data.Status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter().Seconds())))
+	}
+	w.WriteHeader(data.Status)
 
 	bytes, err := json.Marshal(data)
 	if err != nil {
@@ -176,20 +454,21 @@ func readRequestBody(r *http.Request) (template.Data, error) {
 	return data, err
 }
 
-func loadConfig(configFile string) Config {
+func loadConfig(configFile string) (Config, error) {
 	config := Config{}
 
 	// Load the config from the file
 	configData, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		log.Fatalf("Error: %v", err)
+		return config, err
 	}
 
 	errYAML := yaml.Unmarshal([]byte(configData), &config)
 	if errYAML != nil {
-		log.Fatalf("Error: %v", errYAML)
+		return config, errYAML
 	}
 
-	return config
+	errSecrets := resolveSecrets(&config)
+	return config, errSecrets
 
 }
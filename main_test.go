@@ -2,18 +2,30 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/RocketChat/Rocket.Chat.Go.SDK/models"
+	"github.com/gopackage/ddp"
 	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/websocket"
 )
 
 type ConfigDataTest struct {
@@ -24,17 +36,17 @@ type ConfigDataTest struct {
 var valuesCheckConfig = []ConfigDataTest{
 	{
 		input: Config{
-			url.URL{
+			Endpoint: url.URL{
 				Host:   "rocket.chat",
 				Scheme: "https",
 			},
-			models.UserCredentials{
+			Credentials: CredentialsInfo{UserCredentials: models.UserCredentials{
 				Name:     "john",
 				Email:    "123@123",
 				Password: "1234",
-			},
-			map[string]string{},
-			ChannelInfo{
+			}},
+			SeverityColors: map[string]string{},
+			Channel: ChannelInfo{
 				DefaultChannelName: "default",
 			},
 		},
@@ -42,16 +54,16 @@ var valuesCheckConfig = []ConfigDataTest{
 	},
 	{
 		input: Config{
-			url.URL{
+			Endpoint: url.URL{
 				Scheme: "https",
 			},
-			models.UserCredentials{
+			Credentials: CredentialsInfo{UserCredentials: models.UserCredentials{
 				Name:     "john",
 				Email:    "123@123",
 				Password: "1234",
-			},
-			map[string]string{},
-			ChannelInfo{
+			}},
+			SeverityColors: map[string]string{},
+			Channel: ChannelInfo{
 				DefaultChannelName: "default",
 			},
 		},
@@ -59,16 +71,16 @@ var valuesCheckConfig = []ConfigDataTest{
 	},
 	{
 		input: Config{
-			url.URL{
+			Endpoint: url.URL{
 				Host: "rocket.chat",
 			},
-			models.UserCredentials{
+			Credentials: CredentialsInfo{UserCredentials: models.UserCredentials{
 				Name:     "john",
 				Email:    "123@123",
 				Password: "1234",
-			},
-			map[string]string{},
-			ChannelInfo{
+			}},
+			SeverityColors: map[string]string{},
+			Channel: ChannelInfo{
 				DefaultChannelName: "default",
 			},
 		},
@@ -76,16 +88,16 @@ var valuesCheckConfig = []ConfigDataTest{
 	},
 	{
 		input: Config{
-			url.URL{
+			Endpoint: url.URL{
 				Host:   "rocket.chat",
 				Scheme: "https",
 			},
-			models.UserCredentials{
+			Credentials: CredentialsInfo{UserCredentials: models.UserCredentials{
 				Email:    "123@123",
 				Password: "1234",
-			},
-			map[string]string{},
-			ChannelInfo{
+			}},
+			SeverityColors: map[string]string{},
+			Channel: ChannelInfo{
 				DefaultChannelName: "default",
 			},
 		},
@@ -93,16 +105,16 @@ var valuesCheckConfig = []ConfigDataTest{
 	},
 	{
 		input: Config{
-			url.URL{
+			Endpoint: url.URL{
 				Host:   "rocket.chat",
 				Scheme: "https",
 			},
-			models.UserCredentials{
+			Credentials: CredentialsInfo{UserCredentials: models.UserCredentials{
 				Name:     "john",
 				Password: "1234",
-			},
-			map[string]string{},
-			ChannelInfo{
+			}},
+			SeverityColors: map[string]string{},
+			Channel: ChannelInfo{
 				DefaultChannelName: "default",
 			},
 		},
@@ -110,21 +122,46 @@ var valuesCheckConfig = []ConfigDataTest{
 	},
 	{
 		input: Config{
-			url.URL{
+			Endpoint: url.URL{
 				Host:   "rocket.chat",
 				Scheme: "https",
 			},
-			models.UserCredentials{
+			Credentials: CredentialsInfo{UserCredentials: models.UserCredentials{
 				Name:  "john",
 				Email: "123@123",
-			},
-			map[string]string{},
-			ChannelInfo{
+			}},
+			SeverityColors: map[string]string{},
+			Channel: ChannelInfo{
 				DefaultChannelName: "default",
 			},
 		},
 		expected: errors.New("rocket.chat password not provided"),
 	},
+	{
+		input: Config{
+			Endpoint: url.URL{
+				Host:   "rocket.chat",
+				Scheme: "https",
+			},
+			Credentials: CredentialsInfo{UserCredentials: models.UserCredentials{
+				ID:    "user",
+				Token: "personal-access-token",
+			}},
+		},
+		expected: nil,
+	},
+	{
+		input: Config{
+			Endpoint: url.URL{
+				Host:   "rocket.chat",
+				Scheme: "https",
+			},
+			Credentials: CredentialsInfo{UserCredentials: models.UserCredentials{
+				Token: "personal-access-token",
+			}},
+		},
+		expected: errors.New("rocket.chat user id not provided"),
+	},
 }
 
 type MockedClient struct {
@@ -199,7 +236,8 @@ func initMockMessage(text, attachmentText, color, channelName string) {
 	rocketChatMock.On("SendMessage", message).Return(message)
 
 	*configFile = "config/rocketchat_example.yml"
-	config = loadConfig(*configFile)
+	config, _ = loadConfig(*configFile)
+	checkConfig(&config)
 	user := &models.User{ID: "123", Name: "prometheus"}
 	rocketChatMock.On("Login", config).Return(user)
 }
@@ -227,7 +265,7 @@ func TestWebhookHandlerWarning(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	assertWebhookHandler(t, data)
+	assertWebhookHandler(t, data, channelName)
 }
 
 func TestWebhookHandlerCritical(t *testing.T) {
@@ -252,7 +290,7 @@ func TestWebhookHandlerCritical(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	assertWebhookHandler(t, data)
+	assertWebhookHandler(t, data, channelName)
 }
 
 func TestWebhookHandlerUndefined(t *testing.T) {
@@ -277,10 +315,10 @@ func TestWebhookHandlerUndefined(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	assertWebhookHandler(t, data)
+	assertWebhookHandler(t, data, channelName)
 }
 
-func assertWebhookHandler(t *testing.T, data []byte) {
+func assertWebhookHandler(t *testing.T, data []byte, channelName string) {
 
 	// Create a request to pass to the handler
 	req := httptest.NewRequest("GET", "/webhook", bytes.NewReader(data))
@@ -298,8 +336,12 @@ func assertWebhookHandler(t *testing.T, data []byte) {
 	}
 
 	// Check the response body
-	expected := `{"Status":200,"Message":"Success"}`
-	if rr.Body.String() != expected {
+	expected, _ := json.Marshal(JSONResponse{
+		Status:   http.StatusOK,
+		Message:  "Success",
+		Channels: []ChannelResult{{Channel: channelName, Delivered: true}},
+	})
+	if rr.Body.String() != string(expected) {
 		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), expected)
 	}
 }
@@ -321,7 +363,7 @@ func TestWebhookHandlerError(t *testing.T) {
 	}
 
 	// Check the response body
-	expected := `{"Status":400,"Message":"EOF"}`
+	expected := `{"Status":400,"Message":"EOF","Code":"bad_payload"}`
 	if rr.Body.String() != expected {
 		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), expected)
 	}
@@ -330,17 +372,1963 @@ func TestWebhookHandlerError(t *testing.T) {
 func TestCheckConfig(t *testing.T) {
 
 	for _, d := range valuesCheckConfig {
-		configStatus := checkConfig(d.input)
+		configStatus := checkConfig(&d.input)
 		assert.Equal(t, d.expected, configStatus)
 	}
 }
 
-func (mock *MockedClient) GetChannelID(channelName string) (string, error) {
-	args := mock.Called(channelName)
-	return args.String(0), nil
+func TestCheckConfigTemplateError(t *testing.T) {
+	input := valuesCheckConfig[0].input
+	input.Templates = TemplatesInfo{Title: "{{ .Alert.Status"}
+
+	err := checkConfig(&input)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "error parsing title template")
+	}
+
+	input.Templates = TemplatesInfo{Files: []string{"test_templates.tmpl"}, Attachment: "{{ end }}"}
+	err = checkConfig(&input)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "error parsing attachment template")
+	}
 }
 
-func (mock *MockedClient) SendMessage(message *models.Message) (*models.Message, error) {
+func TestFormatMessageTemplates(t *testing.T) {
+	data, err := ioutil.ReadFile("test_param_warning.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/webhook", bytes.NewReader(data))
+	dataReq, err := readRequestBody(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config = valuesCheckConfig[0].input
+	config.Templates = TemplatesInfo{
+		Files:      []string{"test_templates.tmpl"},
+		Title:      `{{ template "rocketchat.test.title" . }}`,
+		Text:       `{{ .CommonAnnotations.summary }}`,
+		Attachment: `{{ .Alert.Annotations.summary | toUpper }}`,
+	}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := config.formatMessage(new(MockedClient), &models.Channel{ID: "test123"}, dataReq.Alerts[0], dataReq)
+	assert.NoError(t, err)
+	assert.Equal(t, "[FIRING] something_happened on server01.int:9100\nrunit service prometheus_bot restarted, server01.int:9100", message.Msg)
+	assert.Equal(t, "OOPS, SOMETHING HAPPENED!", message.PostMessage.Attachments[0].Text)
+}
+
+func TestRouteChannels(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.Routes = []Route{
+		{
+			Name:     "database",
+			Match:    map[string]string{"team": "db"},
+			Channels: []string{"db-alerts"},
+			Continue: true,
+		},
+		{
+			MatchRE:  map[string]string{"cluster": "prod-.*"},
+			Channels: []string{"prod-alerts", "db-alerts"},
+		},
+		{
+			Match:    map[string]string{"cluster": "prod-eu"},
+			Channels: []string{"never"},
+		},
+	}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	values := []struct {
+		labels   template.KV
+		expected []routedChannel
+	}{
+		{
+			labels:   template.KV{"team": "db", "cluster": "prod-eu"},
+			expected: []routedChannel{{"db-alerts", "", "database"}, {"prod-alerts", "", "1"}},
+		},
+		{
+			labels:   template.KV{"team": "web", "cluster": "prod-us"},
+			expected: []routedChannel{{"prod-alerts", "", "1"}, {"db-alerts", "", "1"}},
+		},
+		{
+			labels:   template.KV{"team": "web", "cluster": "staging"},
+			expected: []routedChannel{{"default", "", defaultRoute}},
+		},
+		{
+			labels:   template.KV{"team": "db", defaultChannelLabel: "explicit"},
+			expected: []routedChannel{{"explicit", "", channelLabelRoute}},
+		},
+	}
+	for _, v := range values {
+		assert.Equal(t, v.expected, config.routeChannels(v.labels))
+	}
+}
+
+func TestSendNotificationPerAlertChannel(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.Channel.LabelName = "room"
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "room-a").Return("id-a")
+	rocketChatMock.On("GetChannelID", "room-b").Return("id-b")
+	rocketChatMock.On("GetChannelID", "default").Return("id-default")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{})
+
+	data := template.Data{
+		Receiver:     "admins",
+		Status:       "firing",
+		CommonLabels: template.KV{"alertname": "something_happened"},
+		Alerts: template.Alerts{
+			{Status: "firing", Labels: template.KV{"alertname": "something_happened", "room": "room-a"}},
+			{Status: "firing", Labels: template.KV{"alertname": "something_happened", "room": "room-b"}},
+			{Status: "firing", Labels: template.KV{"alertname": "something_happened", "room": "room-a"}},
+			{Status: "firing", Labels: template.KV{"alertname": "something_happened"}},
+		},
+	}
+
+	results, err := config.SendNotification(rocketChatMock, data)
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+	rocketChatMock.AssertNumberOfCalls(t, "GetChannelID", 3)
+	rocketChatMock.AssertNumberOfCalls(t, "SendMessage", 4)
+
+	batches := config.batchAlerts(data)
+	if assert.Len(t, batches, 3) {
+		assert.Equal(t, "room-a", batches[0].channel)
+		assert.Len(t, batches[0].alerts, 2)
+		assert.Equal(t, "room-b", batches[1].channel)
+		assert.Equal(t, "default", batches[2].channel)
+		assert.Equal(t, []string{defaultRoute}, batches[2].routes)
+	}
+}
+
+func TestFormatGroupMessage(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.GroupingMode = groupingPerNotification
+	config.MaxAttachments = 2
+	config.SeverityColors = map[string]string{"critical": "#ff0000"}
+	config.Templates.Attachment = "{{ .Alert.Labels.instance }}"
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	data := template.Data{
+		Receiver:    "admins",
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "InstanceDown", "job": "node"},
+		Alerts: template.Alerts{
+			{Status: "firing", Labels: template.KV{"instance": "a", "severity": "critical"}},
+			{Status: "resolved", Labels: template.KV{"instance": "b"}},
+			{Status: "firing", Labels: template.KV{"instance": "c"}},
+		},
+	}
+
+	message, err := config.formatGroupMessage(new(MockedClient), &models.Channel{ID: "test123"}, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "**[ firing ] InstanceDown node from admins: 2 firing, 1 resolved**", message.Msg)
+	assert.Equal(t, []models.Attachment{
+		{Color: "#ff0000", Text: "a"},
+		{Color: defaultColor, Text: "b"},
+		{Color: defaultColor, Text: "... and 1 more alert(s)"},
+	}, message.PostMessage.Attachments)
+
+	config.GroupingMode = "per_channel"
+	assert.EqualError(t, checkConfig(&config), `unknown grouping mode "per_channel"`)
+}
+
+func TestSendNotificationEditOnResolve(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.UpdateMode = updateModeEdit
+	config.SeverityColors = map[string]string{"critical": "#ff0000", "resolved": "#00ff00"}
+	config.Templates.Title = "{{ .Alert.Status }}"
+	config.Templates.Attachment = "{{ .Alert.Labels.instance }}"
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	alertMessages = newMemoryStore()
+
+	startsAt := time.Date(2019, 3, 14, 17, 5, 37, 0, time.UTC)
+	endsAt := startsAt.Add(time.Hour)
+	firing := template.Alert{Status: "firing", Labels: template.KV{"instance": "a", "severity": "critical"}, StartsAt: startsAt}
+	resolved := template.Alert{Status: "resolved", Labels: firing.Labels, StartsAt: startsAt, EndsAt: endsAt}
+
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "default").Return("test123")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{ID: "posted-1"}).Once()
+	rocketChatMock.On("EditMessage", mock.Anything).Return(nil).Once()
+
+	_, err := config.SendNotification(rocketChatMock, template.Data{Status: "firing", Alerts: template.Alerts{firing}})
+	assert.NoError(t, err)
+	entry, found := alertMessages.Get(alertKey(firing, "test123"))
+	assert.True(t, found)
+	assert.Equal(t, "posted-1", entry.MessageID)
+
+	_, err = config.SendNotification(rocketChatMock, template.Data{Status: "resolved", Alerts: template.Alerts{resolved}})
+	assert.NoError(t, err)
+	rocketChatMock.AssertNumberOfCalls(t, "SendMessage", 1)
+	edited := rocketChatMock.Calls[len(rocketChatMock.Calls)-1].Arguments.Get(0).(*models.Message)
+	assert.Equal(t, "posted-1", edited.ID)
+	assert.Equal(t, "resolved\n_Resolved at 2019-03-14 18:05:37 +0000 UTC_", edited.Msg)
+	assert.Equal(t, "#00ff00", edited.PostMessage.Attachments[0].Color)
+
+	_, found = alertMessages.Get(alertKey(firing, "test123"))
+	assert.False(t, found)
+}
+
+func TestSendNotificationThread(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.UpdateMode = updateModeThread
+	config.Templates.Title = "{{ .Alert.Status }}"
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	alertMessages = newMemoryStore()
+
+	startsAt := time.Date(2019, 3, 14, 17, 5, 37, 0, time.UTC)
+	firing := template.Alert{Status: "firing", Labels: template.KV{"instance": "a"}, StartsAt: startsAt}
+	resolved := template.Alert{Status: "resolved", Labels: firing.Labels, StartsAt: startsAt, EndsAt: startsAt.Add(time.Hour)}
+
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "default").Return("test123")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{ID: "posted-1"}).Once()
+	rocketChatMock.On("SendThreadMessage", mock.Anything).Return(&models.Message{ID: "reply"}).Twice()
+
+	for _, alert := range []template.Alert{firing, firing, resolved} {
+		_, err := config.SendNotification(rocketChatMock, template.Data{Status: alert.Status, Alerts: template.Alerts{alert}})
+		assert.NoError(t, err)
+	}
+
+	rocketChatMock.AssertNumberOfCalls(t, "SendMessage", 1)
+	rocketChatMock.AssertNumberOfCalls(t, "SendThreadMessage", 2)
+	reply := rocketChatMock.Calls[len(rocketChatMock.Calls)-1].Arguments.Get(0).(*ThreadMessage)
+	assert.Equal(t, "posted-1", reply.ThreadID)
+	assert.Equal(t, "resolved\n_Resolved at 2019-03-14 18:05:37 +0000 UTC_", reply.Msg)
+
+	_, found := alertMessages.Get(alertKey(firing, "test123"))
+	assert.False(t, found)
+}
+
+func TestSendThreadMessage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/chat.sendMessage", r.URL.Path)
+		assert.Equal(t, "token", r.Header.Get("X-Auth-Token"))
+		assert.Equal(t, "user", r.Header.Get("X-User-Id"))
+
+		body := map[string]map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "parent", body["message"]["tmid"])
+		assert.Equal(t, "room", body["message"]["rid"])
+
+		w.Write([]byte(`{"success": true, "message": {"_id": "reply", "rid": "room", "tmid": "parent"}}`))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+
+	message := &models.Message{ID: "123", RoomID: "room", Msg: "resolved"}
+	connector := RocketChatConnector{Session: &models.UserCredentials{ID: "user", Token: "token"}, Endpoint: *serverURL}
+	sent, err := connector.SendThreadMessage(formatThreadMessage(message, "parent"))
+	assert.NoError(t, err)
+	assert.Equal(t, "reply", sent.ID)
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.log")
+
+	store, err := newStateStore(StateInfo{Backend: stateBackendFile, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	assert.NoError(t, store.Set("kept", StateEntry{MessageID: "1", RoomID: "room", Expires: expires}))
+	assert.NoError(t, store.Set("deleted", StateEntry{MessageID: "2", RoomID: "room", Expires: expires}))
+	assert.NoError(t, store.Set("expired", StateEntry{MessageID: "3", RoomID: "room", Expires: time.Now().Add(-time.Hour)}))
+	assert.NoError(t, store.Delete("deleted"))
+	assert.Equal(t, 2, store.Len())
+
+	_, found := store.Get("expired")
+	assert.False(t, found)
+
+	// Reopening the store replays the log and drops the expired entries
+	reopened, err := newStateStore(StateInfo{Backend: stateBackendFile, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, reopened.Len())
+	entry, found := reopened.Get("kept")
+	assert.True(t, found)
+	assert.Equal(t, "1", entry.MessageID)
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(data, []byte("\n")))
+}
+
+// newRocketChatRESTServer returns a stand-in for the Rocket.Chat REST API
+func newRocketChatRESTServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/login", func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if body["user"] != "123@123" || body["password"] != "1234" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status": "error", "error": "Unauthorized"}`))
+			return
+		}
+		w.Write([]byte(`{"status": "success", "data": {"userId": "user", "authToken": "token"}}`))
+	})
+	authenticated := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Auth-Token") != "token" || r.Header.Get("X-User-Id") != "user" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"status": "error", "message": "You must be logged in to do this."}`))
+				return
+			}
+			handler(w, r)
+		}
+	}
+	mux.HandleFunc("/api/v1/me", authenticated(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success": true, "_id": "user", "username": "rocket.cat"}`))
+	}))
+	mux.HandleFunc("/api/v1/rooms.info", authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("roomName") != "prometheus-test-room" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"success": false, "error": "The required \"roomId\" or \"roomName\" param provided does not match any channel [error-room-not-found]"}`))
+			return
+		}
+		w.Write([]byte(`{"success": true, "room": {"_id": "room123", "name": "prometheus-test-room", "t": "c"}}`))
+	}))
+	mux.HandleFunc("/api/v1/im.create", authenticated(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if body["username"] != "alice" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"success": false, "error": "Failed to create direct message [error-invalid-user]"}`))
+			return
+		}
+		w.Write([]byte(`{"success": true, "room": {"_id": "useralice", "rid": "useralice", "t": "d"}}`))
+	}))
+	mux.HandleFunc("/api/v1/chat.postMessage", authenticated(func(w http.ResponseWriter, r *http.Request) {
+		body := models.PostMessage{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "room123", body.RoomID)
+		assert.Len(t, body.Attachments, 1)
+		w.Write([]byte(`{"success": true, "message": {"_id": "posted-1", "rid": "room123", "msg": "` + body.Text + `"}}`))
+	}))
+	mux.HandleFunc("/api/v1/chat.update", authenticated(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "posted-1", body["msgId"])
+		w.Write([]byte(`{"success": true}`))
+	}))
+	return httptest.NewServer(mux)
+}
+
+func TestRESTConnector(t *testing.T) {
+	server := newRocketChatRESTServer(t)
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	connector := NewRESTConnector(*serverURL, time.Second)
+
+	_, err := connector.GetChannelID("prometheus-test-room")
+	assert.EqualError(t, err, "rocket.chat rooms.info failed with status 401: Unauthorized")
+
+	_, err = connector.Login(&models.UserCredentials{Email: "123@123", Password: "wrong"})
+	assert.EqualError(t, err, "rocket.chat login failed with status 401: Unauthorized")
+
+	_, err = connector.Login(&models.UserCredentials{ID: "user", Token: "expired"})
+	assert.EqualError(t, err, "rocket.chat me failed with status 401: Unauthorized")
+
+	user, err := connector.Login(&models.UserCredentials{ID: "user", Token: "token"})
+	assert.NoError(t, err)
+	assert.Equal(t, "rocket.cat", user.UserName)
+
+	user, err = connector.Login(&models.UserCredentials{Email: "123@123", Password: "1234"})
+	assert.NoError(t, err)
+	assert.Equal(t, "user", user.ID)
+
+	channelID, err := connector.GetChannelID("prometheus-test-room")
+	assert.NoError(t, err)
+	assert.Equal(t, "room123", channelID)
+
+	_, err = connector.GetChannelID("unknown")
+	assert.Error(t, err)
+
+	roomID, err := connector.GetDirectMessageRoomID("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "useralice", roomID)
+
+	_, err = connector.GetDirectMessageRoomID("nobody")
+	assert.EqualError(t, err, "rocket.chat im.create failed with status 400: Failed to create direct message [error-invalid-user]")
+	assert.Equal(t, attemptPermanentError, classifyError(err))
+
+	message := connector.NewMessage(&models.Channel{ID: channelID}, "firing")
+	message.PostMessage.Attachments = []models.Attachment{{Color: defaultColor, Text: "details"}}
+	sent, err := connector.SendMessage(message)
+	assert.NoError(t, err)
+	assert.Equal(t, "posted-1", sent.ID)
+	assert.Equal(t, "firing", sent.Msg)
+
+	sent.PostMessage.Attachments = message.PostMessage.Attachments
+	assert.NoError(t, connector.EditMessage(sent))
+}
+
+func TestWebhookHandlerDeliveryErrors(t *testing.T) {
+	server := newRocketChatRESTServer(t)
+	serverURL, _ := url.Parse(server.URL)
+
+	config = valuesCheckConfig[0].input
+	config.Endpoint = *serverURL
+	config.Transport = transportREST
+	config.Retry = RetryInfo{InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Second}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	rocketChat = NewRESTConnector(*serverURL, time.Second)
+
+	post := func(channelName string) *httptest.ResponseRecorder {
+		body := `{"receiver": "admins", "status": "firing", "alerts": [{"status": "firing", "labels": {"alertname": "failing", "channel_name": "` + channelName + `"}}]}`
+		rr := httptest.NewRecorder()
+		webhook(rr, httptest.NewRequest("POST", "/webhook", bytes.NewReader([]byte(body))))
+		return rr
+	}
+	response := func(rr *httptest.ResponseRecorder) JSONResponse {
+		response := JSONResponse{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		return response
+	}
+
+	// The client logs in after the first attempt is refused
+	rr := post("unknown")
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	result := response(rr)
+	assert.Equal(t, codeUnknownChannel, result.Code)
+	if assert.Len(t, result.Channels, 1) {
+		assert.Equal(t, "unknown", result.Channels[0].Channel)
+		assert.False(t, result.Channels[0].Delivered)
+	}
+
+	assert.Equal(t, http.StatusOK, post("prometheus-test-room").Code)
+
+	config.Credentials.Password = "wrong"
+	rocketChat = NewRESTConnector(*serverURL, time.Second)
+	rr = post("prometheus-test-room")
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, codeAuthentication, response(rr).Code)
+
+	server.Close()
+	rr = post("prometheus-test-room")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, codeUnavailable, response(rr).Code)
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+}
+
+func TestIntegrationConnector(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/hooks/integration-id/integration-token", r.URL.Path)
+
+		body := models.PostMessage{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "**[ firing ] something_happened from admins at 0001-01-01 00:00:00 +0000 UTC**", body.Text)
+		assert.Equal(t, "Prometheus", body.Alias)
+		assert.Equal(t, ":fire:", body.Emoji)
+		assert.Equal(t, []models.Attachment{{Color: defaultColor, Text: "**alertname**: something_happened\n"}}, body.Attachments)
+
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer server.Close()
+
+	config = Config{
+		Transport:    transportIntegration,
+		Integrations: map[string]string{"default": server.URL + "/hooks/integration-id/integration-token"},
+		Channel:      ChannelInfo{DefaultChannelName: "default"},
+		Message:      MessageInfo{Alias: "Prometheus", Emoji: ":fire:"},
+	}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	connector, err := GetRocketChat()
+	assert.NoError(t, err)
+	data := template.Data{
+		Receiver: "admins",
+		Alerts:   template.Alerts{{Status: "firing", Labels: template.KV{"alertname": "something_happened"}}},
+	}
+	_, err = config.SendNotification(connector, data)
+	assert.NoError(t, err)
+
+	data.Alerts[0].Labels[defaultChannelLabel] = "unknown"
+	results, err := config.SendNotification(connector, data)
+	assert.EqualError(t, err, "channel unknown: unknown channel unknown: no integration configured")
+	assert.Equal(t, []ChannelResult{{Channel: "unknown", Code: codeUnknownChannel, Message: "unknown channel unknown: no integration configured"}}, results)
+
+	config.Integrations["default"] = "/hooks/integration-id"
+	assert.EqualError(t, checkConfig(&config), "invalid integration URL for channel default")
+	config.Integrations = nil
+	assert.EqualError(t, checkConfig(&config), "rocket.chat integrations not provided")
+}
+
+func TestLoadConfigSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	assert.NoError(t, ioutil.WriteFile(passwordFile, []byte("s3cr3t\n"), 0600))
+	configFile := filepath.Join(dir, "rocketchat.yml")
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(`
+endpoint:
+  scheme: "https"
+  host: "${TEST_ROCKETCHAT_HOST}"
+credentials:
+  name: "john"
+  email: "${TEST_ROCKETCHAT_USER}@example.com"
+  password_file: "`+passwordFile+`"
+integrations:
+  default: "https://${TEST_ROCKETCHAT_HOST}/hooks/${TEST_ROCKETCHAT_HOOK}"
+`), 0600))
+
+	os.Setenv("TEST_ROCKETCHAT_HOST", "chat.example.com")
+	os.Setenv("TEST_ROCKETCHAT_USER", "john")
+	os.Setenv("TEST_ROCKETCHAT_HOOK", "id/token")
+	defer os.Unsetenv("TEST_ROCKETCHAT_HOST")
+	defer os.Unsetenv("TEST_ROCKETCHAT_USER")
+	defer os.Unsetenv("TEST_ROCKETCHAT_HOOK")
+
+	loaded, err := loadConfig(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "chat.example.com", loaded.Endpoint.Host)
+	assert.Equal(t, "john@example.com", loaded.Credentials.Email)
+	assert.Equal(t, "s3cr3t", loaded.Credentials.Password)
+	assert.Equal(t, "https://chat.example.com/hooks/id/token", loaded.Integrations["default"])
+
+	loaded.Integrations["default"] = "https://chat.example.com/hooks/${TEST_ROCKETCHAT_UNSET}"
+	assert.EqualError(t, resolveSecrets(&loaded), "integration URL for channel default: environment variable TEST_ROCKETCHAT_UNSET not set")
+
+	// The environment variables are not expanded in the secret files
+	loaded.Integrations["default"] = "https://chat.example.com/hooks/id/token"
+	assert.NoError(t, ioutil.WriteFile(passwordFile, []byte("pa${ss}word\n"), 0600))
+	assert.NoError(t, resolveSecrets(&loaded))
+	assert.Equal(t, "pa${ss}word", loaded.Credentials.Password)
+
+	loaded.Credentials.TokenFile = filepath.Join(dir, "missing")
+	assert.Error(t, resolveSecrets(&loaded))
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	*configFile = filepath.Join(dir, "rocketchat.yml")
+	writeConfig := func(content string) {
+		assert.NoError(t, ioutil.WriteFile(*configFile, []byte(content), 0600))
+	}
+	reloadSuccessful := func() float64 {
+		metric := &dto.Metric{}
+		assert.NoError(t, configLastReloadSuccessful.Write(metric))
+		return metric.GetGauge().GetValue()
+	}
+
+	config = valuesCheckConfig[0].input
+	rocketChat = new(MockedClient)
+
+	writeConfig(`
+transport: "integration"
+integrations:
+  team-a: "https://chat.example.com/hooks/a"
+channel:
+  default_channel_name: "team-a"
+`)
+	rr := httptest.NewRecorder()
+	reload(rr, httptest.NewRequest("GET", "/-/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+
+	rr = httptest.NewRecorder()
+	reload(rr, httptest.NewRequest("POST", "/-/reload", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "team-a", config.Channel.DefaultChannelName)
+	if assert.IsType(t, &sharedClient{}, rocketChat) {
+		assert.IsType(t, &IntegrationConnector{}, rocketChat.(*sharedClient).RocketChat)
+	}
+	assert.Equal(t, float64(1), reloadSuccessful())
+
+	// An invalid configuration is rejected and the active one is kept
+	writeConfig(`
+transport: "integration"
+channel:
+  default_channel_name: "team-b"
+`)
+	rr = httptest.NewRecorder()
+	reload(rr, httptest.NewRequest("POST", "/-/reload", nil))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, `{"Status":500,"Message":"rocket.chat integrations not provided"}`, rr.Body.String())
+	assert.Equal(t, "team-a", config.Channel.DefaultChannelName)
+	assert.Equal(t, float64(0), reloadSuccessful())
+
+	// The client is kept when the connection settings did not change
+	active := rocketChat
+	writeConfig(`
+transport: "integration"
+integrations:
+  team-a: "https://chat.example.com/hooks/a"
+channel:
+  default_channel_name: "team-b"
+`)
+	assert.NoError(t, reloadConfig(*configFile))
+	assert.Equal(t, "team-b", config.Channel.DefaultChannelName)
+	assert.True(t, active == rocketChat)
+	assert.Equal(t, float64(1), reloadSuccessful())
+
+	// The settings only applied at startup can't be changed, the state TTL can
+	writeConfig(`
+transport: "integration"
+integrations:
+  team-a: "https://chat.example.com/hooks/a"
+channel:
+  default_channel_name: "team-c"
+queue:
+  enabled: true
+spool:
+  directory: "/var/spool/webhook"
+realtime:
+  keepalive_interval: 10s
+`)
+	err = reloadConfig(*configFile)
+	assert.EqualError(t, err, "queue, spool, realtime.keepalive_interval can't be changed by a reload, the webhook must be restarted")
+	assert.Equal(t, "team-b", config.Channel.DefaultChannelName)
+	assert.Equal(t, float64(0), reloadSuccessful())
+
+	writeConfig(`
+transport: "integration"
+integrations:
+  team-a: "https://chat.example.com/hooks/a"
+channel:
+  default_channel_name: "team-c"
+state:
+  ttl: 1h
+`)
+	assert.NoError(t, reloadConfig(*configFile))
+	assert.Equal(t, time.Hour, config.State.ttl())
+}
+
+func TestWebhookHandlerQueue(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan struct{}, 2)
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "default").Return("test123")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{}).Run(func(mock.Arguments) {
+		sent <- struct{}{}
+	})
+	rocketChat = rocketChatMock
+
+	notificationQueue = newQueue(1)
+	defer func() { notificationQueue = nil }()
+
+	body := `{"receiver": "admins", "status": "firing", "alerts": [{"status": "firing", "labels": {"alertname": "queued"}}]}`
+	rr := httptest.NewRecorder()
+	webhook(rr, httptest.NewRequest("POST", "/webhook", bytes.NewReader([]byte(body))))
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Equal(t, `{"Status":202,"Message":"Accepted"}`, rr.Body.String())
+
+	// The queue holds a single notification
+	rr = httptest.NewRecorder()
+	webhook(rr, httptest.NewRequest("POST", "/webhook", bytes.NewReader([]byte(body))))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, 1, notificationQueue.len())
+
+	notificationQueue.start(1)
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Queued notification not delivered")
+	}
+	assert.Equal(t, 0, notificationQueue.len())
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config = valuesCheckConfig[0].input
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "default").Return("test123")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{})
+	rocketChat = rocketChatMock
+
+	s, err := newSpool(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, alertName := range []string{"expired", "first", "second"} {
+		data := template.Data{Alerts: template.Alerts{{Status: "firing", Labels: template.KV{"alertname": alertName}}}}
+		assert.NoError(t, s.add("", data, nil, errors.New("rocket.chat unavailable")))
+	}
+
+	// Age the first notification past the maximum age
+	files := s.files()
+	if assert.Len(t, files, 3) {
+		content, _ := ioutil.ReadFile(files[0])
+		item := spooledNotification{}
+		assert.NoError(t, json.Unmarshal(content, &item))
+		assert.Equal(t, "rocket.chat unavailable", item.LastError)
+		item.Created = time.Now().Add(-2 * time.Hour)
+		assert.NoError(t, s.write(files[0], item))
+	}
+
+	s.replay()
+	assert.Len(t, s.files(), 0)
+	rocketChatMock.AssertNumberOfCalls(t, "SendMessage", 2)
+	first := rocketChatMock.Calls[1].Arguments.Get(0).(*models.Message)
+	assert.Contains(t, first.Msg, "first")
+}
+
+func TestSpoolAddDuringReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config = valuesCheckConfig[0].input
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "default").Return("test123")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{}).Run(func(mock.Arguments) {
+		close(sending)
+		<-release
+	}).Once()
+	rocketChat = rocketChatMock
+
+	s, err := newSpool(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := template.Data{Alerts: template.Alerts{{Status: "firing", Labels: template.KV{"alertname": "spooled"}}}}
+	assert.NoError(t, s.add("", data, nil, errors.New("rocket.chat unavailable")))
+
+	replayed := make(chan struct{})
+	go func() {
+		s.replay()
+		close(replayed)
+	}()
+	<-sending
+
+	// The notification is spooled while the replay is blocked sending
+	added := make(chan error)
+	go func() { added <- s.add("", data, nil, errors.New("rocket.chat unavailable")) }()
+	select {
+	case err := <-added:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Spooling blocked by the replay")
+	}
+
+	close(release)
+	<-replayed
+	assert.Len(t, s.files(), 1)
+}
+
+// flakyChannelClient is a RocketChat mock failing to get the ID of the flaky
+// channel the given number of times, and failing the failingSend-th message
+// sent if set
+type flakyChannelClient struct {
+	MockedClient
+	flaky       string
+	failures    int
+	failingSend int
+	sends       int
+}
+
+func (client *flakyChannelClient) GetChannelID(channelName string) (string, error) {
+	if channelName == client.flaky && client.failures > 0 {
+		client.failures--
+		return "", errors.New("connection reset")
+	}
+	return client.MockedClient.GetChannelID(channelName)
+}
+
+func (client *flakyChannelClient) SendMessage(message *models.Message) (*models.Message, error) {
+	sent, err := client.MockedClient.SendMessage(message)
+	if client.failingSend > 0 {
+		client.sends++
+		if client.sends == client.failingSend {
+			return nil, errors.New("connection reset")
+		}
+	}
+	return sent, err
+}
+
+func newFlakyChannelClient(failures int) *flakyChannelClient {
+	client := &flakyChannelClient{flaky: "b", failures: failures}
+	client.On("GetChannelID", "a").Return("id-a")
+	client.On("GetChannelID", "b").Return("id-b")
+	client.On("SendMessage", mock.Anything).Return(&models.Message{})
+	return client
+}
+
+func TestDeliverRetriesUndeliveredBatches(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.Routes = []Route{{Name: "team", Channels: []string{"a", "b"}}}
+	config.Retry = RetryInfo{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	client := newFlakyChannelClient(1)
+	rocketChat = client
+
+	data := template.Data{Status: "firing", Alerts: template.Alerts{{Status: "firing", Labels: template.KV{"alertname": "retried"}}}}
+	results, undelivered, err := deliver("", data, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, undelivered)
+	assert.Equal(t, []ChannelResult{{Channel: "a", Delivered: true}, {Channel: "b", Delivered: true}}, results)
+
+	// The channel delivered by the first attempt is not sent the alert again
+	client.AssertNumberOfCalls(t, "SendMessage", 2)
+	assert.Equal(t, "id-a", client.Calls[1].Arguments.Get(0).(*models.Message).RoomID)
+	assert.Equal(t, "id-b", client.Calls[3].Arguments.Get(0).(*models.Message).RoomID)
+
+	// The alerts of a channel delivered before the failing one are not sent
+	// again either
+	config.Routes = []Route{{Name: "team", Channels: []string{"a"}}}
+	client = newFlakyChannelClient(0)
+	client.failingSend = 2
+	rocketChat = client
+
+	data.Alerts = template.Alerts{
+		{Status: "firing", Labels: template.KV{"alertname": "first"}},
+		{Status: "firing", Labels: template.KV{"alertname": "second"}},
+		{Status: "firing", Labels: template.KV{"alertname": "third"}},
+	}
+	results, undelivered, err = deliver("", data, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, undelivered)
+	assert.Equal(t, []ChannelResult{{Channel: "a", Delivered: true}}, results)
+
+	var sent []string
+	for _, call := range client.Calls {
+		if call.Method == "SendMessage" {
+			sent = append(sent, call.Arguments.Get(0).(*models.Message).Msg)
+		}
+	}
+	if assert.Len(t, sent, 4) {
+		assert.Contains(t, sent[0], "first")
+		assert.Contains(t, sent[1], "second")
+		assert.Contains(t, sent[2], "second")
+		assert.Contains(t, sent[3], "third")
+	}
+}
+
+func TestSpoolUndeliveredBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config = valuesCheckConfig[0].input
+	config.Routes = []Route{{Name: "team", Channels: []string{"a", "b"}}}
+	config.Retry = RetryInfo{MaxAttempts: 1}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	client := newFlakyChannelClient(1)
+	rocketChat = client
+
+	notificationSpool, err = newSpool(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { notificationSpool = nil }()
+
+	data := template.Data{Status: "firing", Alerts: template.Alerts{{Status: "firing", Labels: template.KV{"alertname": "spooled"}}}}
+	_, undelivered, errSend := deliver("", data, nil)
+	assert.Error(t, errSend)
+	assert.True(t, spoolOrLog("", data, undelivered, errSend))
+
+	// Only the channel that was not delivered is spooled
+	files := notificationSpool.files()
+	if assert.Len(t, files, 1) {
+		item, err := notificationSpool.read(files[0])
+		assert.NoError(t, err)
+		if assert.Len(t, item.Batches, 1) {
+			assert.Equal(t, "b", item.Batches[0].Channel)
+			assert.Equal(t, defaultServerName, item.Batches[0].Server)
+		}
+	}
+
+	notificationSpool.replay()
+	assert.Len(t, notificationSpool.files(), 0)
+	client.AssertNumberOfCalls(t, "SendMessage", 2)
+	assert.Equal(t, "id-b", client.Calls[len(client.Calls)-1].Arguments.Get(0).(*models.Message).RoomID)
+}
+
+func TestWebhookTemplateError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config = valuesCheckConfig[0].input
+	config.Templates = TemplatesInfo{Attachment: `{{ template "missing" . }}`}
+	config.Retry = RetryInfo{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "default").Return("test123")
+	rocketChat = rocketChatMock
+
+	notificationSpool, err = newSpool(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { notificationSpool = nil }()
+
+	// A message that can't be formatted is rejected without being sent
+	// again nor spooled
+	body := `{"status": "firing", "alerts": [{"status": "firing", "labels": {"alertname": "broken"}}]}`
+	rr := httptest.NewRecorder()
+	webhook(rr, httptest.NewRequest("POST", "/webhook", bytes.NewReader([]byte(body))))
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	response := JSONResponse{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, codeTemplate, response.Code)
+	if assert.Len(t, response.Channels, 1) {
+		assert.Equal(t, codeTemplate, response.Channels[0].Code)
+	}
+	rocketChatMock.AssertNumberOfCalls(t, "GetChannelID", 1)
+	rocketChatMock.AssertNotCalled(t, "SendMessage", mock.Anything)
+	assert.Len(t, notificationSpool.files(), 0)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryInfo{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, policy.backoff(1))
+	assert.Equal(t, 2*time.Second, policy.backoff(2))
+	assert.Equal(t, 4*time.Second, policy.backoff(3))
+	assert.Equal(t, 5*time.Second, policy.backoff(4))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		sleep := policy.jittered(2 * time.Second)
+		assert.True(t, sleep >= time.Second && sleep <= 3*time.Second, "jittered backoff %v out of bounds", sleep)
+	}
+
+	assert.EqualError(t, checkRetry(RetryInfo{Multiplier: 0.5}), "retry multiplier must be at least 1")
+	assert.EqualError(t, checkRetry(RetryInfo{Jitter: 2}), "retry jitter must be between 0 and 1")
+	assert.NoError(t, checkRetry(policy))
+}
+
+func TestClassifyError(t *testing.T) {
+	assert.Equal(t, attemptSuccess, classifyError(nil))
+	assert.Equal(t, attemptAuthError, classifyError(&restError{Name: "chat.postMessage", StatusCode: http.StatusUnauthorized}))
+	assert.Equal(t, attemptTransientError, classifyError(&restError{Name: "chat.postMessage", StatusCode: http.StatusTooManyRequests}))
+	assert.Equal(t, attemptTransientError, classifyError(&restError{Name: "chat.postMessage", StatusCode: http.StatusBadGateway}))
+	assert.Equal(t, attemptPermanentError, classifyError(&restError{Name: "rooms.info", StatusCode: http.StatusBadRequest}))
+	assert.Equal(t, attemptPermanentError, classifyError(&restError{Name: "chat.postMessage", StatusCode: http.StatusForbidden}))
+	assert.Equal(t, attemptAuthError, classifyError(errors.New(`{"isClientSafe":true,"error":401,"reason":"You must be logged in to do this."}`)))
+	assert.Equal(t, attemptPermanentError, classifyError(errors.New(`{"isClientSafe":true,"error":403,"reason":"User has no permission"}`)))
+	assert.Equal(t, attemptTransientError, classifyError(errors.New("connection refused")))
+}
+
+func TestRetry(t *testing.T) {
+	policy := RetryInfo{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	var previous []string
+	err := retry(policy, func(outcome string) error {
+		previous = append(previous, outcome)
+		if len(previous) == 1 {
+			return &restError{Name: "chat.postMessage", StatusCode: http.StatusUnauthorized}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{attemptSuccess, attemptAuthError}, previous)
+
+	calls := 0
+	err = retry(policy, func(string) error {
+		calls++
+		return errors.New("connection refused")
+	})
+	assert.EqualError(t, err, "after 3 attempt(s), last error: connection refused")
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = retry(policy, func(string) error {
+		calls++
+		return &restError{Name: "rooms.info", StatusCode: http.StatusBadRequest, Message: "error-room-not-found"}
+	})
+	assert.EqualError(t, err, "after 1 attempt(s), last error: rocket.chat rooms.info failed with status 400: error-room-not-found")
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	policy.InitialBackoff = time.Hour
+	policy.Deadline = time.Second
+	err = retry(policy, func(string) error {
+		calls++
+		return errors.New("connection refused")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	metric := &dto.Metric{}
+	assert.NoError(t, deliveryAttempts.WithLabelValues(attemptPermanentError).Write(metric))
+	assert.True(t, metric.GetCounter().GetValue() >= 1)
+}
+
+func TestWebhookMetrics(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "metrics").Return("test123")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{})
+	rocketChat = rocketChatMock
+
+	counterValue := func(counter prometheus.Counter) float64 {
+		metric := &dto.Metric{}
+		assert.NoError(t, counter.Write(metric))
+		return metric.GetCounter().GetValue()
+	}
+	notifications := counterValue(receivedNotifications.WithLabelValues("firing", "metrics"))
+	resolved := counterValue(receivedAlerts.WithLabelValues("resolved", "metrics"))
+	sent := counterValue(messagesSent.WithLabelValues(defaultServerName, "metrics"))
+
+	body := `{"receiver": "metrics", "status": "firing", "alerts": [
+		{"status": "firing", "labels": {"alertname": "first", "channel_name": "metrics"}},
+		{"status": "resolved", "labels": {"alertname": "second", "channel_name": "metrics"}}
+	]}`
+	handler := promhttp.InstrumentHandlerDuration(webhookDuration, http.HandlerFunc(webhook))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/webhook", bytes.NewReader([]byte(body))))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	assert.Equal(t, notifications+1, counterValue(receivedNotifications.WithLabelValues("firing", "metrics")))
+	assert.Equal(t, resolved+1, counterValue(receivedAlerts.WithLabelValues("resolved", "metrics")))
+	assert.Equal(t, sent+2, counterValue(messagesSent.WithLabelValues(defaultServerName, "metrics")))
+
+	metric := &dto.Metric{}
+	assert.NoError(t, webhookDuration.WithLabelValues("200").(prometheus.Histogram).Write(metric))
+	assert.NotZero(t, metric.GetHistogram().GetSampleCount())
+}
+
+func TestReadiness(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.Readiness = ReadinessInfo{MaxSendAge: time.Minute, ProbeChannel: "probe"}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "probe").Return("probe123")
+	rocketChatMock.On("Login", mock.Anything).Return(&models.User{})
+	rocketChat = rocketChatMock
+	trackedConnections = map[string]*trackedConnection{}
+	health = &healthState{authenticated: map[string]bool{}, lastSuccess: time.Now()}
+
+	probe := func(handler http.HandlerFunc) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("GET", "/", nil))
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, probe(healthy).Code)
+	rr := probe(ready)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, `{"Status":503,"Message":"not authenticated; websocket not connected"}`, rr.Body.String())
+
+	assert.NoError(t, AuthenticateRocketChatClient(rocketChat))
+	trackedConnections[defaultServerName] = &trackedConnection{status: ddp.CONNECTED}
+	assert.Equal(t, http.StatusOK, probe(ready).Code)
+	rocketChatMock.AssertCalled(t, "GetChannelID", "probe")
+
+	// A delivery failure makes the webhook unready once the last success is too old
+	health.lastSuccess = time.Now().Add(-2 * time.Minute)
+	health.recordDelivery(errors.New("connection refused"))
+	assert.Equal(t, http.StatusServiceUnavailable, probe(ready).Code)
+	health.recordDelivery(nil)
+	assert.Equal(t, http.StatusOK, probe(ready).Code)
+}
+
+func TestReadinessLoginRecovery(t *testing.T) {
+	// The Rocket.Chat server is unavailable while down is set
+	var down int32 = 1
+	restServer := newRocketChatRESTServer(t)
+	defer restServer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		restServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	config = valuesCheckConfig[0].input
+	config.Endpoint = *serverURL
+	config.Transport = transportREST
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	rocketChat = NewRESTConnector(*serverURL, time.Second)
+	trackedConnections = map[string]*trackedConnection{}
+	health = &healthState{authenticated: map[string]bool{}, lastSuccess: time.Now()}
+
+	probe := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		ready(rr, httptest.NewRequest("GET", "/", nil))
+		return rr
+	}
+
+	assert.Error(t, AuthenticateRocketChatClient(rocketChat))
+	rr := probe()
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, `{"Status":503,"Message":"not authenticated"}`, rr.Body.String())
+
+	// The readiness probe logs in again once the server is back
+	atomic.StoreInt32(&down, 0)
+	assert.Equal(t, http.StatusOK, probe().Code)
+}
+
+// fakeRealtimeServer is a DDP server answering the login and keepalive
+// methods, which can drop its connections or stop answering the methods
+type fakeRealtimeServer struct {
+	*httptest.Server
+	mutex       sync.Mutex
+	connections []*websocket.Conn
+	logins      int
+	silent      bool
+}
+
+func newFakeRealtimeServer() *fakeRealtimeServer {
+	fake := &fakeRealtimeServer{}
+	fake.Server = httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		fake.mutex.Lock()
+		fake.connections = append(fake.connections, ws)
+		fake.mutex.Unlock()
+
+		for {
+			msg := map[string]interface{}{}
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			switch msg["msg"] {
+			case "connect":
+				websocket.JSON.Send(ws, map[string]interface{}{"msg": "connected", "session": "session"})
+			case "ping":
+				websocket.JSON.Send(ws, map[string]interface{}{"msg": "pong", "id": msg["id"]})
+			case "method":
+				fake.mutex.Lock()
+				silent := fake.silent
+				if msg["method"] == "login" && !silent {
+					fake.logins++
+				}
+				fake.mutex.Unlock()
+				if silent {
+					continue
+				}
+				result := map[string]interface{}{"id": "user", "token": "token"}
+				websocket.JSON.Send(ws, map[string]interface{}{"msg": "result", "id": msg["id"], "result": result})
+			}
+		}
+	}))
+	return fake
+}
+
+// drop closes the connections of the clients
+func (fake *fakeRealtimeServer) drop() {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	for _, ws := range fake.connections {
+		ws.Close()
+	}
+	fake.connections = nil
+}
+
+// setSilent stops or resumes answering the methods
+func (fake *fakeRealtimeServer) setSilent(silent bool) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.silent = silent
+}
+
+// connectionCount returns how many connections the clients opened and were
+// not dropped
+func (fake *fakeRealtimeServer) connectionCount() int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return len(fake.connections)
+}
+
+func (fake *fakeRealtimeServer) loginCount() int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return fake.logins
+}
+
+func TestSuperviseRealtime(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the realtime client is not safe for the race detector")
+	}
+	server := newFakeRealtimeServer()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	config = valuesCheckConfig[0].input
+	config.Endpoint = *serverURL
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	client, err := GetRocketChat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rocketChat = client
+	defer closeRocketChat(client)
+	assert.NoError(t, AuthenticateRocketChatClient(rocketChat))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go superviseRealtime(20*time.Millisecond, stop)
+
+	eventually := func(condition func() bool) bool {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if condition() {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The supervisor reconnects the client, which logs in again
+	server.drop()
+	assert.True(t, eventually(func() bool { return server.loginCount() == 2 }), "client not logged in after reconnection")
+	assert.True(t, eventually(func() bool { return trackedConnectionStatus(defaultServerName) == ddp.CONNECTED }), "client not reconnected")
+
+	metric := &dto.Metric{}
+	assert.NoError(t, realtimeReconnects.WithLabelValues(defaultServerName).Write(metric))
+	assert.NotZero(t, metric.GetCounter().GetValue())
+}
+
+func TestCloseRocketChat(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the realtime client is not safe for the race detector")
+	}
+	defer func(interval time.Duration) { realtimeReconnectInterval = interval }(realtimeReconnectInterval)
+	realtimeReconnectInterval = 10 * time.Millisecond
+
+	server := newFakeRealtimeServer()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	client, err := newRocketChat(ServerInfo{Name: defaultServerName, Endpoint: *serverURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, server.connectionCount())
+
+	// The client reconnects once its connection is lost, unless it was closed
+	server.drop()
+	for deadline := time.Now().Add(2 * time.Second); server.connectionCount() == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 1, server.connectionCount(), "client not reconnected")
+
+	closeRocketChat(client)
+	time.Sleep(20 * realtimeReconnectInterval)
+	assert.Equal(t, 1, server.connectionCount())
+}
+
+func TestNewRocketChatConnectionRefused(t *testing.T) {
+	defer func(interval time.Duration) { realtimeReconnectInterval = interval }(realtimeReconnectInterval)
+	realtimeReconnectInterval = 10 * time.Millisecond
+
+	var dials int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&dials, 1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	// A client that failed to connect does not try again
+	_, err := newRocketChat(ServerInfo{Name: defaultServerName, Endpoint: *serverURL})
+	assert.Error(t, err)
+	time.Sleep(20 * realtimeReconnectInterval)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+}
+
+func TestSuperviseRealtimeTimeout(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the realtime client is not safe for the race detector")
+	}
+	server := newFakeRealtimeServer()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	config = valuesCheckConfig[0].input
+	config.Endpoint = *serverURL
+	config.Timeout = 100 * time.Millisecond
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	client, err := GetRocketChat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rocketChat = client
+	defer func() { closeRocketChat(rocketChat) }()
+	assert.NoError(t, AuthenticateRocketChatClient(rocketChat))
+
+	// The calls on a connection that stopped answering fail once the
+	// timeout is over instead of blocking the client
+	server.setSilent(true)
+	sent := make(chan error)
+	go func() {
+		_, errSend := rocketChat.SendMessage(&models.Message{RoomID: "test123", Msg: "stuck"})
+		sent <- errSend
+	}()
+	select {
+	case errSend := <-sent:
+		assert.EqualError(t, errSend, "realtime call sendMessage timed out after 100ms")
+	case <-time.After(time.Second):
+		t.Fatal("Realtime call not bounded by the timeout")
+	}
+
+	supervised := make(chan int)
+	go func() { supervised <- superviseServer(defaultServerName, config.Realtime, 0) }()
+	select {
+	case failures := <-supervised:
+		assert.Equal(t, 1, failures)
+	case <-time.After(time.Second):
+		t.Fatal("Supervisor blocked by the stuck connection")
+	}
+
+	// The client is closed and rebuilt once it failed to reconnect too many times
+	server.setSilent(false)
+	old := rocketChat
+	assert.Equal(t, 0, superviseServer(defaultServerName, config.Realtime, config.Realtime.maxReconnectFailures()))
+	assert.NotEqual(t, old, rocketChat)
+	assert.Equal(t, 2, server.loginCount())
+}
+
+// concurrentClient is a RocketChat mock refusing the sends until logged in,
+// which records the number of logins and of concurrent calls
+type concurrentClient struct {
+	MockedClient
+	release   chan struct{}
+	loggedIn  int32
+	logins    int32
+	inFlight  int32
+	maxFlight int32
+}
+
+func (client *concurrentClient) Login(credentials *models.UserCredentials) (*models.User, error) {
+	atomic.AddInt32(&client.logins, 1)
+	if client.release != nil {
+		<-client.release
+	}
+	atomic.StoreInt32(&client.loggedIn, 1)
+	return &models.User{}, nil
+}
+
+func (client *concurrentClient) GetChannelID(channelName string) (string, error) {
+	return channelName, nil
+}
+
+func (client *concurrentClient) SendMessage(message *models.Message) (*models.Message, error) {
+	inFlight := atomic.AddInt32(&client.inFlight, 1)
+	defer atomic.AddInt32(&client.inFlight, -1)
+	for {
+		maxFlight := atomic.LoadInt32(&client.maxFlight)
+		if inFlight <= maxFlight || atomic.CompareAndSwapInt32(&client.maxFlight, maxFlight, inFlight) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+
+	if atomic.LoadInt32(&client.loggedIn) == 0 {
+		return nil, &restError{Name: "chat.postMessage", StatusCode: http.StatusUnauthorized, Message: "You must be logged in to do this."}
+	}
+	return message, nil
+}
+
+func TestSharedClientSingleFlightLogin(t *testing.T) {
+	connector := &concurrentClient{release: make(chan struct{})}
+	client := newSharedClient(connector, 1)
+
+	var started, done sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		started.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			started.Done()
+			_, err := client.Login(&models.UserCredentials{})
+			assert.NoError(t, err)
+		}()
+	}
+	started.Wait()
+	time.Sleep(20 * time.Millisecond)
+	close(connector.release)
+	done.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connector.logins))
+}
+
+func TestWebhookHandlerConcurrent(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.Transport = transportREST
+	config.MaxConcurrentSends = 3
+	config.Retry = RetryInfo{MaxAttempts: 5, InitialBackoff: time.Millisecond}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	connector := &concurrentClient{}
+	rocketChat = newSharedClient(connector, config.defaultServer().maxConcurrentSends())
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"receiver": "admins", "status": "firing", "alerts": [{"status": "firing", "labels": {"alertname": "concurrent-%d"}}]}`, i)
+			rr := httptest.NewRecorder()
+			webhook(rr, httptest.NewRequest("POST", "/webhook", bytes.NewReader([]byte(body))))
+			codes <- rr.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+	assert.True(t, atomic.LoadInt32(&connector.maxFlight) <= 3, "%d concurrent sends", connector.maxFlight)
+	assert.True(t, atomic.LoadInt32(&connector.logins) >= 1)
+}
+
+func TestCheckConfigMaxConcurrentSends(t *testing.T) {
+	input := valuesCheckConfig[0].input
+	input.MaxConcurrentSends = 1
+	assert.NoError(t, checkConfig(&input))
+
+	input.MaxConcurrentSends = 4
+	assert.EqualError(t, checkConfig(&input), "max concurrent sends must be 1 with the realtime transport")
+
+	input.Transport = transportREST
+	assert.NoError(t, checkConfig(&input))
+}
+
+func TestCheckConfigRouteError(t *testing.T) {
+	input := valuesCheckConfig[0].input
+
+	input.Routes = []Route{{Match: map[string]string{"team": "db"}}}
+	assert.EqualError(t, checkConfig(&input), "route 0: no channels provided")
+
+	input.Routes = []Route{{Name: "broken", MatchRE: map[string]string{"team": "(db"}, Channels: []string{"db"}}}
+	assert.EqualError(t, checkConfig(&input), `route broken: invalid regular expression "(db"`)
+}
+
+func TestSendNotificationServers(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.Servers = []ServerInfo{{
+		Name:        "ops",
+		Endpoint:    url.URL{Scheme: "https", Host: "ops.chat"},
+		Transport:   transportREST,
+		Credentials: CredentialsInfo{UserCredentials: models.UserCredentials{ID: "bot", Token: "token"}},
+		Receivers:   []string{"ops-team"},
+	}}
+	config.Routes = []Route{{Name: "db", Match: map[string]string{"team": "db"}, Channels: []string{"db-alerts"}, Server: "ops", Continue: true}}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	defaultMock := new(MockedClient)
+	defaultMock.On("GetChannelID", "default").Return("id-default")
+	defaultMock.On("SendMessage", mock.Anything).Return(&models.Message{})
+	opsMock := new(MockedClient)
+	opsMock.On("GetChannelID", "db-alerts").Return("id-db")
+	opsMock.On("GetChannelID", "default").Return("id-ops-default")
+	opsMock.On("SendMessage", mock.Anything).Return(&models.Message{})
+	serverClients = map[string]RocketChat{"ops": opsMock}
+	defer func() { serverClients = map[string]RocketChat{} }()
+
+	data := template.Data{
+		Receiver: "admins",
+		Status:   "firing",
+		Alerts: template.Alerts{
+			{Status: "firing", Labels: template.KV{"alertname": "db_down", "team": "db"}},
+			{Status: "firing", Labels: template.KV{"alertname": "web_down"}},
+		},
+	}
+
+	// The route selects the server of its channels, the other alerts go to
+	// the default server
+	results, err := config.SendNotification(defaultMock, data)
+	assert.NoError(t, err)
+	assert.Equal(t, []ChannelResult{
+		{Channel: "db-alerts", Server: "ops", Delivered: true},
+		{Channel: "default", Delivered: true},
+	}, results)
+	defaultMock.AssertNumberOfCalls(t, "SendMessage", 1)
+	opsMock.AssertNumberOfCalls(t, "SendMessage", 1)
+	metric := &dto.Metric{}
+	assert.NoError(t, messagesSent.WithLabelValues("ops", "db-alerts").Write(metric))
+	assert.NotZero(t, metric.GetCounter().GetValue())
+
+	// The notifications of the receivers of a server go to that server
+	data.Receiver = "ops-team"
+	batches := config.batchAlerts(data)
+	if assert.Len(t, batches, 2) {
+		assert.Equal(t, "ops", batches[0].server)
+		assert.Equal(t, "ops", batches[1].server)
+		assert.Equal(t, "default", batches[1].channel)
+	}
+
+	// A server without client fails the delivery to its channels only
+	delete(serverClients, "ops")
+	results, err = config.SendNotification(defaultMock, data)
+	assert.EqualError(t, err, "channel db-alerts on server ops: no client for the server; channel default on server ops: no client for the server")
+	assert.Len(t, results, 2)
+}
+
+func TestCheckConfigServerError(t *testing.T) {
+	input := valuesCheckConfig[0].input
+	ops := ServerInfo{
+		Name:         "ops",
+		Transport:    transportIntegration,
+		Integrations: map[string]string{"ops": "https://ops.chat/hooks/ops"},
+	}
+
+	input.Servers = []ServerInfo{{Transport: transportIntegration}}
+	assert.EqualError(t, checkConfig(&input), "server 0: no name provided")
+
+	input.Servers = []ServerInfo{ops, ops}
+	assert.EqualError(t, checkConfig(&input), "server ops defined more than once")
+
+	input.Servers = []ServerInfo{{Name: defaultServerName}}
+	assert.EqualError(t, checkConfig(&input), `server name "default" is reserved for the top level server`)
+
+	input.Servers = []ServerInfo{{Name: "ops", Transport: transportIntegration}}
+	assert.EqualError(t, checkConfig(&input), "server ops: rocket.chat integrations not provided")
+
+	input.Servers = []ServerInfo{ops}
+	input.Routes = []Route{{Name: "db", Channels: []string{"db"}, Server: "dev"}}
+	assert.EqualError(t, checkConfig(&input), "route db: unknown server dev")
+}
+
+func TestReloadConfigDuringDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	*configFile = filepath.Join(dir, "rocketchat.yml")
+	assert.NoError(t, ioutil.WriteFile(*configFile, []byte(`
+transport: "integration"
+integrations:
+  team-a: "https://chat.example.com/hooks/a"
+channel:
+  default_channel_name: "team-a"
+`), 0600))
+
+	config = valuesCheckConfig[0].input
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "default").Return("test123")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{}).Run(func(mock.Arguments) {
+		close(sending)
+		<-release
+	}).Once()
+	rocketChat = rocketChatMock
+
+	delivered := make(chan error)
+	go func() {
+		data := template.Data{Status: "firing", Alerts: template.Alerts{{Status: "firing", Labels: template.KV{"alertname": "slow"}}}}
+		_, _, errSend := deliver("", data, nil)
+		delivered <- errSend
+	}()
+	<-sending
+
+	// The reload and the readers of the configuration do not wait for the
+	// notification being sent
+	reloaded := make(chan error)
+	go func() { reloaded <- reloadConfig(*configFile) }()
+	select {
+	case err := <-reloaded:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Reload blocked by the delivery")
+	}
+	assert.True(t, hasProfile(""))
+
+	close(release)
+	assert.NoError(t, <-delivered)
+	configMutex.RLock()
+	assert.Equal(t, "team-a", config.Channel.DefaultChannelName)
+	configMutex.RUnlock()
+}
+
+func TestReloadConfigDuringEditDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	*configFile = filepath.Join(dir, "rocketchat.yml")
+	assert.NoError(t, ioutil.WriteFile(*configFile, []byte(`
+transport: "integration"
+integrations:
+  team-a: "https://chat.example.com/hooks/a"
+`), 0600))
+
+	config = valuesCheckConfig[0].input
+	config.UpdateMode = updateModeEdit
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	alertMessages = newMemoryStore()
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "default").Return("test123")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{ID: "msg1"}).Run(func(mock.Arguments) {
+		close(sending)
+		<-release
+	}).Once()
+	rocketChat = rocketChatMock
+
+	delivered := make(chan error)
+	go func() {
+		data := template.Data{Status: "firing", Alerts: template.Alerts{{Status: "firing", Labels: template.KV{"alertname": "slow"}}}}
+		_, _, errSend := deliver("", data, nil)
+		delivered <- errSend
+	}()
+	<-sending
+
+	// The state of the message is stored after the configuration is swapped,
+	// with the TTL of the configuration it was sent with. The delivery is
+	// released without waiting on the reload, so that the race detector sees
+	// a read of the active configuration.
+	reloaded := make(chan error)
+	go func() { reloaded <- reloadConfig(*configFile) }()
+	start := time.Now()
+	time.Sleep(500 * time.Millisecond)
+	t.Log(time.Since(start))
+	close(release)
+	assert.NoError(t, <-reloaded)
+	assert.NoError(t, <-delivered)
+	assert.Equal(t, 1, alertMessages.Len())
+	alertMessages = newMemoryStore()
+}
+
+func TestReloadConfigServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	*configFile = filepath.Join(dir, "rocketchat.yml")
+	writeConfig := func(content string) {
+		assert.NoError(t, ioutil.WriteFile(*configFile, []byte(content), 0600))
+	}
+
+	config = valuesCheckConfig[0].input
+	rocketChat = new(MockedClient)
+	serverClients = map[string]RocketChat{}
+
+	writeConfig(`
+transport: "integration"
+integrations:
+  team-a: "https://chat.example.com/hooks/a"
+servers:
+  - name: "ops"
+    transport: "integration"
+    integrations:
+      ops: "https://ops.example.com/hooks/ops"
+channel:
+  default_channel_name: "team-a"
+`)
+	assert.NoError(t, reloadConfig(*configFile))
+	opsClient := serverClient("ops")
+	if assert.IsType(t, &sharedClient{}, opsClient) {
+		assert.IsType(t, &IntegrationConnector{}, opsClient.(*sharedClient).RocketChat)
+	}
+
+	// The clients of the removed servers are dropped
+	writeConfig(`
+transport: "integration"
+integrations:
+  team-a: "https://chat.example.com/hooks/a"
+channel:
+  default_channel_name: "team-a"
+`)
+	assert.NoError(t, reloadConfig(*configFile))
+	assert.Nil(t, serverClient("ops"))
+	assert.Empty(t, serverClients)
+}
+
+func TestWebhookHandlerProfiles(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.SeverityColors = map[string]string{"warning": "#ffff00", "critical": "#ff0000"}
+	config.Profiles = map[string]ProfileInfo{
+		"team-a": {
+			Channel:        ChannelInfo{DefaultChannelName: "team-a"},
+			SeverityColors: map[string]string{"critical": "#aa0000"},
+			Templates:      TemplatesInfo{Title: "team-a: {{ .Alert.Labels.alertname }}"},
+		},
+	}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "team-a").Return("id-team-a")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{})
+	rocketChat = rocketChatMock
+
+	body := `{"receiver": "team-a", "status": "firing", "alerts": [
+		{"status": "firing", "labels": {"alertname": "disk_full", "severity": "critical"}},
+		{"status": "firing", "labels": {"alertname": "disk_slow", "severity": "warning"}}
+	]}`
+	post := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		webhook(rr, httptest.NewRequest("POST", path, bytes.NewReader([]byte(body))))
+		return rr
+	}
+
+	// The profile selects the default channel, the colors and the templates
+	rr := post("/webhook/team-a")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rocketChatMock.AssertCalled(t, "SendMessage", mock.MatchedBy(func(message *models.Message) bool {
+		return message.Msg == "team-a: disk_full" && message.PostMessage.Attachments[0].Color == "#aa0000"
+	}))
+	rocketChatMock.AssertCalled(t, "SendMessage", mock.MatchedBy(func(message *models.Message) bool {
+		return message.Msg == "team-a: disk_slow" && message.PostMessage.Attachments[0].Color == "#ffff00"
+	}))
+
+	// The unknown profiles are not found
+	rr = post("/webhook/team-b")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, `{"Status":404,"Message":"unknown profile team-b","Code":"unknown_profile"}`, rr.Body.String())
+	rocketChatMock.AssertNumberOfCalls(t, "SendMessage", 2)
+
+	config.Profiles = map[string]ProfileInfo{"team-a": {Server: "ops"}}
+	assert.EqualError(t, checkConfig(&config), "profile team-a: unknown server ops")
+}
+
+func TestWebhookHandlerReceivers(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.Profiles = map[string]ProfileInfo{
+		"team-a": {Channel: ChannelInfo{DefaultChannelName: "team-a"}, Templates: TemplatesInfo{Title: "team-a: {{ .Alert.Labels.alertname }}"}},
+	}
+	config.Receivers = map[string]ReceiverInfo{
+		"db": {
+			Channel:        ChannelInfo{DefaultChannelName: "db-alerts"},
+			SeverityColors: map[string]string{"critical": "#aa0000"},
+			Templates:      TemplatesInfo{GroupTitle: "db: {{ .Alerts | len }} alert(s)"},
+			GroupingMode:   groupingPerNotification,
+		},
+	}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "db-alerts").Return("id-db")
+	rocketChatMock.On("GetChannelID", "team-a").Return("id-team-a")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{})
+	rocketChat = rocketChatMock
+
+	post := func(path, receiver string) *httptest.ResponseRecorder {
+		body := `{"receiver": "` + receiver + `", "status": "firing", "alerts": [
+			{"status": "firing", "labels": {"alertname": "replication_lag", "severity": "critical"}},
+			{"status": "firing", "labels": {"alertname": "slow_queries", "severity": "critical"}}
+		]}`
+		rr := httptest.NewRecorder()
+		webhook(rr, httptest.NewRequest("POST", path, bytes.NewReader([]byte(body))))
+		return rr
+	}
+
+	// The receiver selects the channel, the colors, the templates and the grouping
+	assert.Equal(t, http.StatusOK, post("/webhook/team-a", "db").Code)
+	rocketChatMock.AssertNumberOfCalls(t, "SendMessage", 1)
+	rocketChatMock.AssertCalled(t, "SendMessage", mock.MatchedBy(func(message *models.Message) bool {
+		return message.RoomID == "id-db" && message.Msg == "db: 2 alert(s)" &&
+			len(message.PostMessage.Attachments) == 2 && message.PostMessage.Attachments[0].Color == "#aa0000"
+	}))
+
+	// The other receivers use the settings of the profile
+	assert.Equal(t, http.StatusOK, post("/webhook/team-a", "web").Code)
+	rocketChatMock.AssertNumberOfCalls(t, "SendMessage", 3)
+	rocketChatMock.AssertCalled(t, "SendMessage", mock.MatchedBy(func(message *models.Message) bool {
+		return message.RoomID == "id-team-a" && message.Msg == "team-a: slow_queries"
+	}))
+
+	config.UpdateMode = updateModeEdit
+	assert.EqualError(t, checkConfig(&config), `receiver db: update mode "edit" requires grouping mode "per_alert"`)
+}
+
+func TestSendNotificationMentions(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.Templates.Title = "{{ .Alert.Labels.alertname }}"
+	config.Mentions = MentionsInfo{Rules: []MentionRule{
+		{Match: map[string]string{"severity": "critical"}, Mentions: []string{"@here"}},
+		{Match: map[string]string{"team": "db"}, Mentions: []string{"db-oncall"}},
+		{MatchRE: map[string]string{"alertname": "cert_.*"}, Annotation: "owners"},
+	}}
+	config.Receivers = map[string]ReceiverInfo{"quiet": {Mentions: &MentionsInfo{}}}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	mentionsSent = &mentionLimiter{until: map[string]time.Time{}}
+
+	var sent []string
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetChannelID", "default").Return("id-default")
+	rocketChatMock.On("SendMessage", mock.Anything).Run(func(args mock.Arguments) {
+		sent = append(sent, args.Get(0).(*models.Message).Msg)
+	}).Return(&models.Message{})
+
+	dbDown := template.Alert{Status: "firing", Labels: template.KV{"alertname": "db_down", "severity": "critical", "team": "db"}}
+	certExpiry := template.Alert{
+		Status:      "firing",
+		Labels:      template.KV{"alertname": "cert_expiry"},
+		Annotations: template.KV{"owners": "alice, @bob"},
+	}
+	send := func(receiver string, alerts ...template.Alert) {
+		_, err := config.withReceiver(receiver).SendNotification(rocketChatMock, template.Data{Receiver: receiver, Status: "firing", Alerts: alerts})
+		assert.NoError(t, err)
+	}
+
+	// The mentions of the matching rules are prepended to the message
+	send("team", dbDown, certExpiry)
+	assert.Equal(t, []string{"@here @db-oncall db_down", "@alice @bob cert_expiry"}, sent)
+
+	// The repeats don't mention again within the rate limit
+	sent = nil
+	send("team", dbDown)
+	assert.Equal(t, []string{"db_down"}, sent)
+
+	// The resolved alerts don't mention
+	sent = nil
+	resolved := certExpiry
+	resolved.Status = "resolved"
+	resolved.StartsAt = time.Now()
+	send("team", resolved)
+	assert.Equal(t, []string{"cert_expiry"}, sent)
+
+	// A receiver can replace the mention rules
+	sent = nil
+	mentionsSent = &mentionLimiter{until: map[string]time.Time{}}
+	send("quiet", dbDown)
+	assert.Equal(t, []string{"db_down"}, sent)
+
+	config.Mentions.Rules = []MentionRule{{Match: map[string]string{"team": "db"}}}
+	assert.EqualError(t, checkConfig(&config), "mention rule 0: no mentions or annotation provided")
+}
+
+func TestSendNotificationDirectMessage(t *testing.T) {
+	config = valuesCheckConfig[0].input
+	config.Routes = []Route{{Match: map[string]string{"alertname": "cert_expiry"}, Channels: []string{"@alice", "ops"}}}
+	if err := checkConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	rocketChatMock := new(MockedClient)
+	rocketChatMock.On("GetDirectMessageRoomID", "alice").Return("useralice")
+	rocketChatMock.On("GetChannelID", "ops").Return("id-ops")
+	rocketChatMock.On("SendMessage", mock.Anything).Return(&models.Message{})
+
+	data := template.Data{
+		Status: "firing",
+		Alerts: template.Alerts{{Status: "firing", Labels: template.KV{"alertname": "cert_expiry"}}},
+	}
+	results, err := config.SendNotification(rocketChatMock, data)
+	assert.NoError(t, err)
+	assert.Equal(t, []ChannelResult{{Channel: "@alice", Delivered: true}, {Channel: "ops", Delivered: true}}, results)
+	rocketChatMock.AssertNotCalled(t, "GetChannelID", "@alice")
+	rocketChatMock.AssertCalled(t, "SendMessage", mock.MatchedBy(func(message *models.Message) bool {
+		return message.RoomID == "useralice"
+	}))
+
+	// The integrations of the users are configured for @username
+	connector := NewIntegrationConnector(map[string]string{"@alice": "https://chat.example.com/hooks/alice"}, time.Second)
+	roomID, err := connector.GetDirectMessageRoomID("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "@alice", roomID)
+	_, err = connector.GetDirectMessageRoomID("bob")
+	assert.EqualError(t, err, "unknown channel @bob: no integration configured")
+}
+
+func (mock *MockedClient) GetChannelID(channelName string) (string, error) {
+	args := mock.Called(channelName)
+	return args.String(0), nil
+}
+
+func (mock *MockedClient) GetDirectMessageRoomID(username string) (string, error) {
+	args := mock.Called(username)
+	return args.String(0), nil
+}
+
+func (mock *MockedClient) SendMessage(message *models.Message) (*models.Message, error) {
+	args := mock.Called(message)
+	return args.Get(0).(*models.Message), nil
+}
+
+func (mock *MockedClient) EditMessage(message *models.Message) error {
+	args := mock.Called(message)
+	return args.Error(0)
+}
+
+func (mock *MockedClient) SendThreadMessage(message *ThreadMessage) (*models.Message, error) {
 	args := mock.Called(message)
 	return args.Get(0).(*models.Message), nil
 }
@@ -354,6 +2342,6 @@ func (mock *MockedClient) NewMessage(channel *models.Channel, text string) *mode
 }
 
 func (mock *MockedClient) Login(credentials *models.UserCredentials) (*models.User, error) {
-	args := mock.Called(&config.Credentials)
+	args := mock.Called(&config.Credentials.UserCredentials)
 	return args.Get(0).(*models.User), nil
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/alertmanager/types"
+	"github.com/prometheus/common/model"
+)
+
+const defaultMentionRateLimit = time.Hour
+
+// MentionsInfo - Mentions configuration
+type MentionsInfo struct {
+	Rules     []MentionRule `yaml:"rules"`
+	RateLimit time.Duration `yaml:"rate_limit"`
+}
+
+// MentionRule - Label based mention rule. The alerts matching the rule
+// mention the users and groups of the rule, and the usernames listed in the
+// annotation of the rule.
+type MentionRule struct {
+	Match      map[string]string `yaml:"match"`
+	MatchRE    map[string]string `yaml:"match_re"`
+	Mentions   []string          `yaml:"mentions"`
+	Annotation string            `yaml:"annotation"`
+
+	matchers types.Matchers
+}
+
+// rateLimit returns how long an alert does not mention anyone again after it did
+func (info MentionsInfo) rateLimit() time.Duration {
+	if info.RateLimit > 0 {
+		return info.RateLimit
+	}
+	return defaultMentionRateLimit
+}
+
+// loadMentions validates the mention rules and builds their label matchers
+func loadMentions(info *MentionsInfo) error {
+	if info.RateLimit < 0 {
+		return errors.New("mentions rate limit must be positive")
+	}
+	for i := range info.Rules {
+		rule := &info.Rules[i]
+		if len(rule.Mentions) == 0 && rule.Annotation == "" {
+			return fmt.Errorf("mention rule %d: no mentions or annotation provided", i)
+		}
+		matchers, errMatchers := newMatchers(rule.Match, rule.MatchRE)
+		if errMatchers != nil {
+			return fmt.Errorf("mention rule %d: %v", i, errMatchers)
+		}
+		rule.matchers = matchers
+	}
+	return nil
+}
+
+// alertMentions returns the mentions of the alert, none once it is resolved
+func (info MentionsInfo) alertMentions(alert template.Alert) []string {
+	if alert.Status == string(model.AlertResolved) {
+		return nil
+	}
+
+	labelSet := newLabelSet(alert.Labels)
+	var mentions []string
+	for _, rule := range info.Rules {
+		if !rule.matchers.Match(labelSet) {
+			continue
+		}
+		candidates := rule.Mentions
+		if rule.Annotation != "" {
+			candidates = append(append([]string{}, candidates...), strings.FieldsFunc(alert.Annotations[rule.Annotation], isMentionSeparator)...)
+		}
+		for _, mention := range candidates {
+			if !strings.HasPrefix(mention, "@") {
+				mention = "@" + mention
+			}
+			if !containsString(mentions, mention) {
+				mentions = append(mentions, mention)
+			}
+		}
+	}
+	return mentions
+}
+
+func isMentionSeparator(r rune) bool {
+	return r == ',' || r == ' ' || r == '\t' || r == '\n'
+}
+
+// mentionLimiter remembers until when the alerts that mentioned someone must
+// not mention anyone again
+type mentionLimiter struct {
+	mutex sync.Mutex
+	until map[string]time.Time
+}
+
+var mentionsSent = &mentionLimiter{until: map[string]time.Time{}}
+
+// allowed returns whether the alert identified by key may mention again
+func (limiter *mentionLimiter) allowed(key string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	return !time.Now().Before(limiter.until[key])
+}
+
+// record remembers the alert identified by key mentioned someone, and
+// forgets the alerts whose rate limit expired
+func (limiter *mentionLimiter) record(key string, rateLimit time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	for other, until := range limiter.until {
+		if !now.Before(until) {
+			delete(limiter.until, other)
+		}
+	}
+	limiter.until[key] = now.Add(rateLimit)
+}
+
+// mentions returns the mentions of the alerts posted in the room, leaving out
+// the alerts that already mentioned someone within the rate limit
+func (config Config) mentions(alerts template.Alerts, roomID string) []string {
+	var mentions []string
+	for _, alert := range alerts {
+		if !mentionsSent.allowed(alertKey(alert, roomID)) {
+			continue
+		}
+		for _, mention := range config.Mentions.alertMentions(alert) {
+			if !containsString(mentions, mention) {
+				mentions = append(mentions, mention)
+			}
+		}
+	}
+	return mentions
+}
+
+// recordMentions starts the rate limit of the alerts posted in the room that
+// mentioned someone, once their message was sent
+func (config Config) recordMentions(alerts template.Alerts, roomID string) {
+	for _, alert := range alerts {
+		if !mentionsSent.allowed(alertKey(alert, roomID)) {
+			continue
+		}
+		if len(config.Mentions.alertMentions(alert)) > 0 {
+			mentionsSent.record(alertKey(alert, roomID), config.Mentions.rateLimit())
+		}
+	}
+}
+
+// withMentions prepends the mentions to the message text
+func withMentions(mentions []string, text string) string {
+	if len(mentions) == 0 {
+		return text
+	}
+	return strings.Join(mentions, " ") + " " + text
+}
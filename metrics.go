@@ -0,0 +1,228 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "alertmanager_webhook_rocketchat"
+
+var (
+	receivedNotifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "notifications_received_total",
+			Help:      "Number of notifications received from AlertManager, by status and receiver.",
+		},
+		[]string{"status", "receiver"},
+	)
+	receivedAlerts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "alerts_received_total",
+			Help:      "Number of alerts received from AlertManager, by status and receiver.",
+		},
+		[]string{"status", "receiver"},
+	)
+	messagesSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_sent_total",
+			Help:      "Number of messages sent to Rocket.Chat, by server and channel.",
+		},
+		[]string{"server", "channel"},
+	)
+	messagesFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_failed_total",
+			Help:      "Number of messages that could not be sent to Rocket.Chat, by server and channel.",
+		},
+		[]string{"server", "channel"},
+	)
+	sendDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "send_duration_seconds",
+			Help:      "Time spent sending a message to Rocket.Chat.",
+			Buckets:   prometheus.DefBuckets,
+		},
+	)
+	webhookDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "webhook_duration_seconds",
+			Help:      "Time spent handling a notification from AlertManager, by HTTP status code.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"code"},
+	)
+	loginAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "login_attempts_total",
+			Help:      "Number of attempts to log in to Rocket.Chat, by server.",
+		},
+		[]string{"server"},
+	)
+	loginFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "login_failures_total",
+			Help:      "Number of failed attempts to log in to Rocket.Chat, by server.",
+		},
+		[]string{"server"},
+	)
+	connectionState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connection_state",
+			Help:      "State of the realtime connection to Rocket.Chat, by server: 0 disconnected, 1 dialing, 2 connecting, 3 connected.",
+		},
+		[]string{"server"},
+	)
+	realtimeReconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "realtime_reconnects_total",
+			Help:      "Number of attempts to reconnect the realtime client, by server.",
+		},
+		[]string{"server"},
+	)
+	realtimeRebuilds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "realtime_rebuilds_total",
+			Help:      "Number of times the realtime client was rebuilt after failing to reconnect, by server.",
+		},
+		[]string{"server"},
+	)
+	keepaliveFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "realtime_keepalive_failures_total",
+			Help:      "Number of keepalives of the realtime session that failed, by server.",
+		},
+		[]string{"server"},
+	)
+	routedNotifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "routed_notifications_total",
+			Help:      "Number of notifications routed to a channel, by route.",
+		},
+		[]string{"route", "channel"},
+	)
+	deliveryAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "delivery_attempts_total",
+			Help:      "Number of attempts to deliver a notification, by outcome.",
+		},
+		[]string{"outcome"},
+	)
+	stateEntries = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "state_entries",
+			Help:      "Number of alert messages held in the state store.",
+		},
+		func() float64 { return float64(alertMessages.Len()) },
+	)
+	queueDepth = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "queue_depth",
+			Help:      "Number of notifications waiting in the delivery queue.",
+		},
+		func() float64 {
+			if notificationQueue == nil {
+				return 0
+			}
+			return float64(notificationQueue.len())
+		},
+	)
+	queueDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "queue_dropped_total",
+			Help:      "Number of notifications dropped because the delivery queue was full.",
+		},
+	)
+	queueAge = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "queue_age_seconds",
+			Help:      "Time spent by the notifications in the delivery queue.",
+			Buckets:   []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60},
+		},
+	)
+	spoolSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "spool_size",
+			Help:      "Number of undelivered notifications waiting in the spool.",
+		},
+	)
+	spooledNotifications = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "spooled_notifications_total",
+			Help:      "Number of undelivered notifications written to the spool.",
+		},
+	)
+	replayedNotifications = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "spool_replayed_notifications_total",
+			Help:      "Number of spooled notifications delivered.",
+		},
+	)
+	discardedNotifications = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "spool_discarded_notifications_total",
+			Help:      "Number of spooled notifications discarded before delivery.",
+		},
+	)
+	configLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful.",
+		},
+	)
+	configLastReloadSuccessTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(receivedNotifications)
+	prometheus.MustRegister(receivedAlerts)
+	prometheus.MustRegister(messagesSent)
+	prometheus.MustRegister(messagesFailed)
+	prometheus.MustRegister(sendDuration)
+	prometheus.MustRegister(webhookDuration)
+	prometheus.MustRegister(loginAttempts)
+	prometheus.MustRegister(loginFailures)
+	prometheus.MustRegister(connectionState)
+	prometheus.MustRegister(realtimeReconnects)
+	prometheus.MustRegister(realtimeRebuilds)
+	prometheus.MustRegister(keepaliveFailures)
+	prometheus.MustRegister(routedNotifications)
+	prometheus.MustRegister(deliveryAttempts)
+	prometheus.MustRegister(stateEntries)
+	prometheus.MustRegister(queueDepth)
+	prometheus.MustRegister(queueDropped)
+	prometheus.MustRegister(queueAge)
+	prometheus.MustRegister(spoolSize)
+	prometheus.MustRegister(spooledNotifications)
+	prometheus.MustRegister(replayedNotifications)
+	prometheus.MustRegister(discardedNotifications)
+	prometheus.MustRegister(configLastReloadSuccessful)
+	prometheus.MustRegister(configLastReloadSuccessTimestamp)
+}
@@ -0,0 +1,8 @@
+//go:build !race
+// +build !race
+
+package main
+
+// raceEnabled is true when the tests run with the race detector, which
+// reports the data races of the vendored realtime client
+const raceEnabled = false
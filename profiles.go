@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	webhookPath       = "/webhook"
+	webhookPathPrefix = webhookPath + "/"
+)
+
+// ProfileInfo - Webhook path configuration. The notifications posted to
+// /webhook/<profile> use the default channel, colors, templates and server of
+// the profile instead of the top level ones.
+type ProfileInfo struct {
+	Channel        ChannelInfo       `yaml:"channel"`
+	SeverityColors map[string]string `yaml:"severity_colors"`
+	Templates      TemplatesInfo     `yaml:"templates"`
+	Server         string            `yaml:"server"`
+
+	templates TemplatesInfo
+}
+
+// webhookProfile returns the profile of the webhook path, empty for /webhook
+func webhookProfile(r *http.Request) string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, webhookPath), "/")
+}
+
+// hasProfile returns whether the profile is configured, the empty profile
+// being the top level settings
+func hasProfile(name string) bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	_, exists := config.Profiles[name]
+	return name == "" || exists
+}
+
+// withProfile returns the configuration with the settings of the profile
+// taking precedence over the top level ones
+func (config Config) withProfile(name string) (Config, bool) {
+	if name == "" {
+		return config, true
+	}
+	profile, exists := config.Profiles[name]
+	if !exists {
+		return config, false
+	}
+
+	if profile.Channel.DefaultChannelName != "" {
+		config.Channel.DefaultChannelName = profile.Channel.DefaultChannelName
+	}
+	if profile.Channel.LabelName != "" {
+		config.Channel.LabelName = profile.Channel.LabelName
+	}
+	config.SeverityColors = mergeColors(config.SeverityColors, profile.SeverityColors)
+	config.Templates = profile.templates
+	if profile.Server != "" {
+		config.profileServer = profile.Server
+	}
+	return config, true
+}
+
+// mergeColors returns the colors with the overrides taking precedence
+func mergeColors(colors, overrides map[string]string) map[string]string {
+	if len(overrides) == 0 {
+		return colors
+	}
+	merged := make(map[string]string, len(colors)+len(overrides))
+	for key, color := range colors {
+		merged[key] = color
+	}
+	for key, color := range overrides {
+		merged[key] = color
+	}
+	return merged
+}
+
+// checkProfiles checks the server of the profiles and loads their templates,
+// merged with the top level ones
+func checkProfiles(config *Config) error {
+	for name, profile := range config.Profiles {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid profile name %q", name)
+		}
+		if _, exists := config.server(profile.Server); profile.Server != "" && !exists {
+			return fmt.Errorf("profile %s: unknown server %s", name, profile.Server)
+		}
+		profile.templates = config.Templates.override(profile.Templates)
+		if err := loadTemplates(&profile.templates); err != nil {
+			return fmt.Errorf("profile %s: %v", name, err)
+		}
+		config.Profiles[name] = profile
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	defaultQueueSize    = 100
+	defaultQueueWorkers = 2
+)
+
+// QueueInfo - Asynchronous delivery configuration
+type QueueInfo struct {
+	Enabled bool `yaml:"enabled"`
+	Size    int  `yaml:"size"`
+	Workers int  `yaml:"workers"`
+}
+
+// size returns the maximum number of queued notifications
+func (info QueueInfo) size() int {
+	if info.Size > 0 {
+		return info.Size
+	}
+	return defaultQueueSize
+}
+
+// workers returns the number of notifications delivered concurrently
+func (info QueueInfo) workers() int {
+	if info.Workers > 0 {
+		return info.Workers
+	}
+	return defaultQueueWorkers
+}
+
+// queuedNotification is a notification waiting for delivery, and the profile
+// of the webhook path it was posted to
+type queuedNotification struct {
+	profile  string
+	data     template.Data
+	enqueued time.Time
+}
+
+// queue is a bounded queue of notifications delivered by a pool of workers
+type queue struct {
+	items chan queuedNotification
+}
+
+// notificationQueue is the queue of the webhook, nil when notifications are
+// delivered synchronously
+var notificationQueue *queue
+
+func newQueue(size int) *queue {
+	return &queue{items: make(chan queuedNotification, size)}
+}
+
+// enqueue adds the notification to the queue, it returns false and drops the
+// notification if the queue is full
+func (q *queue) enqueue(profile string, data template.Data) bool {
+	select {
+	case q.items <- queuedNotification{profile: profile, data: data, enqueued: time.Now()}:
+		return true
+	default:
+		queueDropped.Inc()
+		log.Warnf("Queue full, dropping notification for %s", data.Receiver)
+		return false
+	}
+}
+
+// len returns the number of queued notifications
+func (q *queue) len() int {
+	return len(q.items)
+}
+
+// start starts the workers delivering the queued notifications
+func (q *queue) start(workers int) {
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+}
+
+func (q *queue) work() {
+	for item := range q.items {
+		queueAge.Observe(time.Since(item.enqueued).Seconds())
+		_, undelivered, errSend := deliver(item.profile, item.data, nil)
+		if errSend != nil && !spoolOrLog(item.profile, item.data, undelivered, errSend) {
+			log.Errorf("Error sending queued notifications to RocketChat : %v", errSend)
+		}
+	}
+}
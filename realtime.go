@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/RocketChat/Rocket.Chat.Go.SDK/realtime"
+	"github.com/gopackage/ddp"
+	"github.com/prometheus/common/log"
+)
+
+// realtimeReconnectInterval is how long the realtime client waits before
+// reconnecting a lost connection
+var realtimeReconnectInterval = 5 * time.Second
+
+var errNoDDPClient = errors.New("realtime client has no ddp client")
+
+// newRealtimeClient connects a realtime client to the server. It does what
+// realtime.NewClient does, except that the client is shut down when it fails
+// to connect: the ddp client would otherwise keep reconnecting a client that
+// is never returned.
+func newRealtimeClient(serverURL *url.URL) (*realtime.Client, error) {
+	rand.Seed(time.Now().UTC().UnixNano())
+
+	scheme := "ws"
+	port := 80
+	if serverURL.Scheme == "https" {
+		scheme = "wss"
+		port = 443
+	}
+	if len(serverURL.Port()) > 0 {
+		port, _ = strconv.Atoi(serverURL.Port())
+	}
+	wsURL := fmt.Sprintf("%s://%v:%v%s/websocket", scheme, serverURL.Hostname(), port, serverURL.Path)
+
+	ddpClient := ddp.NewClient(wsURL, serverURL.String())
+	ddpClient.ReconnectInterval = realtimeReconnectInterval
+	client := new(realtime.Client)
+	ddpField, errField := unexportedField(reflect.ValueOf(client).Elem(), "ddp", reflect.TypeOf(ddpClient))
+	if errField != nil {
+		return nil, errField
+	}
+	ddpField.Set(reflect.ValueOf(ddpClient))
+
+	log.Infof("Connecting to %s", wsURL)
+	if errConnect := ddpClient.Connect(); errConnect != nil {
+		shutdownDDPClient(ddpClient)
+		return nil, errConnect
+	}
+	return client, nil
+}
+
+// shutdownRealtimeClient closes the realtime client for good. realtime.Client
+// Close only closes the websocket, which the ddp client then reconnects.
+func shutdownRealtimeClient(client *realtime.Client) {
+	ddpField, errField := unexportedField(reflect.ValueOf(client).Elem(), "ddp", reflect.TypeOf(&ddp.Client{}))
+	if errField == nil && ddpField.IsNil() {
+		errField = errNoDDPClient
+	}
+	if errField != nil {
+		log.Errorf("Error shutting down realtime client, closing it instead: %v", errField)
+		client.Close()
+		return
+	}
+	shutdownDDPClient(ddpField.Interface().(*ddp.Client))
+}
+
+// shutdownDDPClient closes the ddp client and stops it from reconnecting. The
+// ddp client schedules a reconnection only when it has no reconnection timer,
+// so it is given one that never fires. A reconnection already dialing when
+// the client is shut down is closed as soon as it is connected.
+func shutdownDDPClient(client *ddp.Client) {
+	value := reflect.ValueOf(client).Elem()
+	lockField, errLock := unexportedField(value, "reconnectLock", reflect.TypeOf(&sync.Mutex{}))
+	timerField, errTimer := unexportedField(value, "reconnectTimer", reflect.TypeOf(&time.Timer{}))
+	if errLock != nil || errTimer != nil {
+		log.Errorf("Error stopping the reconnections of the realtime client: %v", firstError(errLock, errTimer))
+		client.Close()
+		return
+	}
+
+	client.AddStatusListener(shutdownListener{client: client})
+	never := time.NewTimer(time.Hour)
+	never.Stop()
+
+	lock := lockField.Interface().(*sync.Mutex)
+	lock.Lock()
+	if timer, _ := timerField.Interface().(*time.Timer); timer != nil {
+		timer.Stop()
+	}
+	timerField.Set(reflect.ValueOf(never))
+	lock.Unlock()
+
+	client.Close()
+}
+
+// shutdownListener closes the ddp client again when a reconnection that was
+// in progress when it was shut down connects it
+type shutdownListener struct {
+	client *ddp.Client
+}
+
+func (listener shutdownListener) Status(status int) {
+	if status == ddp.CONNECTED {
+		go listener.client.Close()
+	}
+}
+
+// unexportedField returns a settable value of the unexported field of the
+// struct value, checking it still has the expected type
+func unexportedField(value reflect.Value, name string, fieldType reflect.Type) (reflect.Value, error) {
+	field := value.FieldByName(name)
+	if !field.IsValid() || field.Type() != fieldType {
+		return reflect.Value{}, fmt.Errorf("no field %s of type %v in %v", name, fieldType, value.Type())
+	}
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem(), nil
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
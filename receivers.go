@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ReceiverInfo - AlertManager receiver configuration. The notifications of
+// the receiver use its default channel, colors, templates, mentions and
+// grouping mode instead of the ones of the top level settings or of the profile.
+type ReceiverInfo struct {
+	Channel        ChannelInfo       `yaml:"channel"`
+	SeverityColors map[string]string `yaml:"severity_colors"`
+	Templates      TemplatesInfo     `yaml:"templates"`
+	Mentions       *MentionsInfo     `yaml:"mentions"`
+	GroupingMode   string            `yaml:"grouping_mode"`
+
+	templates TemplatesInfo
+}
+
+// withReceiver returns the configuration with the settings of the receiver
+// taking precedence
+func (config Config) withReceiver(name string) Config {
+	receiver, exists := config.Receivers[name]
+	if !exists {
+		return config
+	}
+
+	if receiver.Channel.DefaultChannelName != "" {
+		config.Channel.DefaultChannelName = receiver.Channel.DefaultChannelName
+	}
+	if receiver.Channel.LabelName != "" {
+		config.Channel.LabelName = receiver.Channel.LabelName
+	}
+	config.SeverityColors = mergeColors(config.SeverityColors, receiver.SeverityColors)
+	// The inline templates of the receiver are rendered with the template
+	// files of the profile, unless the receiver has its own files
+	templates := config.Templates.override(receiver.Templates)
+	templates.template = config.Templates.template
+	if len(receiver.Templates.Files) > 0 {
+		templates.template = receiver.templates.template
+	}
+	config.Templates = templates
+	if receiver.Mentions != nil {
+		config.Mentions = *receiver.Mentions
+	}
+	if receiver.GroupingMode != "" {
+		config.GroupingMode = receiver.GroupingMode
+	}
+	return config
+}
+
+// checkReceivers checks the grouping mode and the mentions of the receivers
+// and loads their templates, merged with the top level ones
+func checkReceivers(config *Config) error {
+	for name, receiver := range config.Receivers {
+		switch receiver.GroupingMode {
+		case "", groupingPerAlert:
+		case groupingPerNotification:
+			if config.UpdateMode == updateModeEdit || config.UpdateMode == updateModeThread {
+				return fmt.Errorf("receiver %s: update mode %q requires grouping mode %q", name, config.UpdateMode, groupingPerAlert)
+			}
+		default:
+			return fmt.Errorf("receiver %s: unknown grouping mode %q", name, receiver.GroupingMode)
+		}
+		if receiver.Mentions != nil {
+			if err := loadMentions(receiver.Mentions); err != nil {
+				return fmt.Errorf("receiver %s: %v", name, err)
+			}
+		}
+		receiver.templates = config.Templates.override(receiver.Templates)
+		if err := loadTemplates(&receiver.templates); err != nil {
+			return fmt.Errorf("receiver %s: %v", name, err)
+		}
+		config.Receivers[name] = receiver
+	}
+	return nil
+}
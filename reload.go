@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// configMutex protects the configuration and the clients swapped by a
+// reload. It is only held to read or swap them, never while calling
+// Rocket.Chat.
+var configMutex sync.RWMutex
+
+// reloadMutex serializes the reloads
+var reloadMutex sync.Mutex
+
+// activeConfig returns a snapshot of the active configuration, holding the
+// clients of its servers, and the client of the default server. A reload
+// swaps them for new ones without waiting for the snapshots to be released.
+func activeConfig() (Config, RocketChat) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	snapshot := config
+	snapshot.clients = map[string]RocketChat{defaultServerName: rocketChat}
+	for name, client := range serverClients {
+		snapshot.clients[name] = client
+	}
+	return snapshot, rocketChat
+}
+
+// reloadConfig loads and validates the configuration file and makes it the
+// active configuration. The client of a server is rebuilt if its connection
+// settings changed and authenticated again if its credentials changed too.
+// The clients of the removed servers are closed. The active configuration is
+// kept if the new one is invalid or changes the settings only applied at
+// startup.
+func reloadConfig(configFile string) error {
+	newConfig, errConfig := loadConfig(configFile)
+	if errConfig == nil {
+		errConfig = checkConfig(&newConfig)
+	}
+	if errConfig != nil {
+		setConfigReloadSuccess(false)
+		return errConfig
+	}
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	// The new clients are created and authenticated before anything is
+	// swapped, so that the active configuration and clients are kept if one
+	// of them fails and the notifications are not held up meanwhile
+	active, _ := activeConfig()
+	if errStartup := checkStartupSettings(active, newConfig); errStartup != nil {
+		setConfigReloadSuccess(false)
+		return errStartup
+	}
+	newClients := map[string]RocketChat{}
+	var authenticate []ServerInfo
+	for _, server := range newConfig.servers() {
+		oldServer, exists := active.server(server.Name)
+		if !exists || !server.sameConnection(oldServer) || active.client(server.Name) == nil {
+			newClient, errClient := newRocketChat(server)
+			if errClient != nil {
+				for _, client := range newClients {
+					closeRocketChat(client)
+				}
+				setConfigReloadSuccess(false)
+				return errClient
+			}
+			newClients[server.Name] = newClient
+			authenticateServerOrLog(server, newClient)
+		} else if server.Credentials.UserCredentials != oldServer.Credentials.UserCredentials {
+			authenticate = append(authenticate, server)
+		}
+	}
+
+	for _, oldClient := range swapConfig(newConfig, newClients) {
+		closeRocketChat(oldClient)
+	}
+
+	// The clients kept for a server whose account changed log in again
+	reloaded, _ := activeConfig()
+	for _, server := range authenticate {
+		if client := reloaded.client(server.Name); client != nil {
+			authenticateServerOrLog(server, client)
+		}
+	}
+
+	setConfigReloadSuccess(true)
+	return nil
+}
+
+// checkStartupSettings checks the new configuration keeps the settings only
+// applied at startup: the queue, the spool, the state store but its TTL, and
+// the keepalive interval of the realtime clients
+func checkStartupSettings(active, newConfig Config) error {
+	var changed []string
+	if active.Queue != newConfig.Queue {
+		changed = append(changed, "queue")
+	}
+	if active.Spool != newConfig.Spool {
+		changed = append(changed, "spool")
+	}
+	if active.State.Backend != newConfig.State.Backend || active.State.Path != newConfig.State.Path || active.State.GCInterval != newConfig.State.GCInterval {
+		changed = append(changed, "state")
+	}
+	if active.Realtime.KeepaliveInterval != newConfig.Realtime.KeepaliveInterval {
+		changed = append(changed, "realtime.keepalive_interval")
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("%s can't be changed by a reload, the webhook must be restarted", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// swapConfig makes newConfig the active configuration, with the new clients
+// of its servers, and returns the clients it replaced
+func swapConfig(newConfig Config, newClients map[string]RocketChat) []RocketChat {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	var oldClients []RocketChat
+	for _, oldServer := range config.Servers {
+		if _, exists := newConfig.server(oldServer.Name); !exists {
+			oldClients = append(oldClients, serverClients[oldServer.Name])
+			delete(serverClients, oldServer.Name)
+			untrackConnection(oldServer.Name)
+			health.forget(oldServer.Name)
+		}
+	}
+	for name, newClient := range newClients {
+		oldClients = append(oldClients, swapServerClient(name, newClient))
+	}
+	config = newConfig
+	return oldClients
+}
+
+// closeRocketChat closes the connection of the realtime client for good, the
+// client does not reconnect afterwards
+func closeRocketChat(connector RocketChat) {
+	if rtConnector, ok := realtimeConnector(connector); ok && rtConnector.Client != nil {
+		shutdownRealtimeClient(rtConnector.Client)
+	}
+}
+
+func setConfigReloadSuccess(success bool) {
+	if success {
+		configLastReloadSuccessful.Set(1)
+		configLastReloadSuccessTimestamp.Set(float64(time.Now().Unix()))
+	} else {
+		configLastReloadSuccessful.Set(0)
+	}
+}
+
+// reloadOnSIGHUP reloads the configuration every time the process receives SIGHUP
+func reloadOnSIGHUP(configFile string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Info("Reloading configuration file")
+		if err := reloadConfig(configFile); err != nil {
+			log.Errorf("Error reloading configuration: %v", err)
+		}
+	}
+}
+
+// reload reloads the configuration on POST /-/reload
+func reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "Only POST requests allowed")
+		return
+	}
+
+	log.Info("Reloading configuration file")
+	if err := reloadConfig(*configFile); err != nil {
+		log.Errorf("Error reloading configuration: %v", err)
+		sendJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, "Success")
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RocketChat/Rocket.Chat.Go.SDK/models"
+)
+
+const restAPIPath = "/api/v1/"
+
+var restHTTPClient = &http.Client{Timeout: defaultTimeout}
+
+// restResponse holds the status common to all the REST API responses, login
+// uses status instead of success
+type restResponse struct {
+	Success bool   `json:"success"`
+	Status  string `json:"status"`
+	Error   string `json:"error"`
+}
+
+// restError is the error of a call answered with an error status
+type restError struct {
+	Name       string
+	StatusCode int
+	Message    string
+}
+
+func (err *restError) Error() string {
+	return fmt.Sprintf("rocket.chat %s failed with status %d: %s", err.Name, err.StatusCode, err.Message)
+}
+
+// restMessageResponse is the response of the chat.* REST API methods
+type restMessageResponse struct {
+	restResponse
+	Message models.Message `json:"message"`
+}
+
+// restCall performs a call to the Rocket.Chat REST API method given by path,
+// which may hold a query string, authenticated with the user ID and token of
+// the credentials, and decodes the JSON response into result
+func restCall(client *http.Client, endpoint url.URL, credentials *models.UserCredentials, httpMethod, path string, body interface{}, result interface{}) error {
+	method, query := path, ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		method, query = path[:i], path[i+1:]
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + restAPIPath + method
+	endpoint.RawQuery = query
+
+	return jsonCall(client, httpMethod, endpoint.String(), method, credentials, body, result)
+}
+
+// jsonCall sends body encoded in JSON to target and decodes the JSON response
+// into result. The call fails unless the response reports a success, name
+// identifies the call in the errors.
+func jsonCall(client *http.Client, httpMethod, target, name string, credentials *models.UserCredentials, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, errJSON := json.Marshal(body)
+		if errJSON != nil {
+			return errJSON
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, errRequest := http.NewRequest(httpMethod, target, reader)
+	if errRequest != nil {
+		return errRequest
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if credentials != nil && credentials.Token != "" {
+		req.Header.Set("X-Auth-Token", credentials.Token)
+		req.Header.Set("X-User-Id", credentials.ID)
+	}
+
+	resp, errResponse := client.Do(req)
+	if errResponse != nil {
+		return errResponse
+	}
+	defer resp.Body.Close()
+
+	status := restResponse{}
+	data := new(bytes.Buffer)
+	if _, errRead := data.ReadFrom(resp.Body); errRead != nil {
+		return errRead
+	}
+	// Not every method returns a JSON body on error, so the status is best effort
+	json.Unmarshal(data.Bytes(), &status)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || !(status.Success || status.Status == "success") {
+		if status.Error == "" {
+			status.Error = http.StatusText(resp.StatusCode)
+		}
+		return &restError{Name: name, StatusCode: resp.StatusCode, Message: status.Error}
+	}
+
+	if result != nil {
+		return json.Unmarshal(data.Bytes(), result)
+	}
+	return nil
+}
+
+// restLoginResponse is the response of the login REST API method
+type restLoginResponse struct {
+	restResponse
+	Data struct {
+		UserID    string `json:"userId"`
+		AuthToken string `json:"authToken"`
+	} `json:"data"`
+}
+
+// restMeResponse is the response of the me REST API method
+type restMeResponse struct {
+	restResponse
+	ID       string `json:"_id"`
+	UserName string `json:"username"`
+	Name     string `json:"name"`
+}
+
+// restRoomResponse is the response of the rooms.info REST API method
+type restRoomResponse struct {
+	restResponse
+	Room models.Channel `json:"room"`
+}
+
+// restDirectMessageResponse is the response of the im.create REST API method
+type restDirectMessageResponse struct {
+	restResponse
+	Room struct {
+		ID     string `json:"_id"`
+		RoomID string `json:"rid"`
+	} `json:"room"`
+}
+
+// createDirectMessage returns the ID of the direct message room with the
+// user, creating the room if needed, with im.create
+func createDirectMessage(client *http.Client, endpoint url.URL, session *models.UserCredentials, username string) (string, error) {
+	response := restDirectMessageResponse{}
+	errRoom := restCall(client, endpoint, session, http.MethodPost, "im.create", map[string]string{"username": username}, &response)
+	if errRoom != nil {
+		return "", errRoom
+	}
+	if response.Room.ID != "" {
+		return response.Room.ID, nil
+	}
+	return response.Room.RoomID, nil
+}
+
+// RESTConnector is the RocketChat client using the REST API
+type RESTConnector struct {
+	Endpoint url.URL
+	Client   *http.Client
+
+	mutex   sync.RWMutex
+	session *models.UserCredentials
+}
+
+// NewRESTConnector returns a REST client with the given per-call timeout
+func NewRESTConnector(endpoint url.URL, timeout time.Duration) *RESTConnector {
+	return &RESTConnector{
+		Endpoint: endpoint,
+		Client:   &http.Client{Timeout: timeout},
+	}
+}
+
+func (connector *RESTConnector) call(method, path string, body, result interface{}) error {
+	connector.mutex.RLock()
+	session := connector.session
+	connector.mutex.RUnlock()
+
+	return restCall(connector.Client, connector.Endpoint, session, method, path, body, result)
+}
+
+// Login authenticates with the password, or checks the token of the
+// credentials, and keeps the session for the next calls
+func (connector *RESTConnector) Login(credentials *models.UserCredentials) (*models.User, error) {
+	if credentials.Password == "" && credentials.Token != "" {
+		me := restMeResponse{}
+		errMe := restCall(connector.Client, connector.Endpoint, credentials, http.MethodGet, "me", nil, &me)
+		if errMe != nil {
+			return nil, errMe
+		}
+		connector.setSession(credentials.ID, credentials.Token)
+		return &models.User{ID: me.ID, UserName: me.UserName, Name: me.Name, Token: credentials.Token}, nil
+	}
+
+	user := credentials.Email
+	if user == "" {
+		user = credentials.Name
+	}
+	login := restLoginResponse{}
+	errLogin := restCall(connector.Client, connector.Endpoint, nil, http.MethodPost, "login", map[string]string{
+		"user":     user,
+		"password": credentials.Password,
+	}, &login)
+	if errLogin != nil {
+		return nil, errLogin
+	}
+	connector.setSession(login.Data.UserID, login.Data.AuthToken)
+	return &models.User{ID: login.Data.UserID, Token: login.Data.AuthToken}, nil
+}
+
+func (connector *RESTConnector) setSession(userID, token string) {
+	connector.mutex.Lock()
+	defer connector.mutex.Unlock()
+
+	connector.session = &models.UserCredentials{ID: userID, Token: token}
+}
+
+// GetChannelID returns the ID of the room named channelName
+func (connector *RESTConnector) GetChannelID(channelName string) (string, error) {
+	room := restRoomResponse{}
+	errRoom := connector.call(http.MethodGet, "rooms.info?roomName="+url.QueryEscape(channelName), nil, &room)
+	if errRoom != nil {
+		return "", errRoom
+	}
+	return room.Room.ID, nil
+}
+
+// GetDirectMessageRoomID returns the ID of the direct message room with the user
+func (connector *RESTConnector) GetDirectMessageRoomID(username string) (string, error) {
+	connector.mutex.RLock()
+	session := connector.session
+	connector.mutex.RUnlock()
+
+	return createDirectMessage(connector.Client, connector.Endpoint, session, username)
+}
+
+// SendMessage posts the message with chat.postMessage
+func (connector *RESTConnector) SendMessage(message *models.Message) (*models.Message, error) {
+	postMessage := message.PostMessage
+	postMessage.RoomID = message.RoomID
+	postMessage.Text = message.Msg
+
+	response := restMessageResponse{}
+	errMessage := connector.call(http.MethodPost, "chat.postMessage", postMessage, &response)
+	if errMessage != nil {
+		return nil, errMessage
+	}
+	return &response.Message, nil
+}
+
+// EditMessage updates the text and attachments of the message with chat.update
+func (connector *RESTConnector) EditMessage(message *models.Message) error {
+	return connector.call(http.MethodPost, "chat.update", map[string]interface{}{
+		"roomId":      message.RoomID,
+		"msgId":       message.ID,
+		"text":        message.Msg,
+		"attachments": message.PostMessage.Attachments,
+	}, nil)
+}
+
+// SendThreadMessage posts the message in a thread with chat.sendMessage
+func (connector *RESTConnector) SendThreadMessage(message *ThreadMessage) (*models.Message, error) {
+	response := restMessageResponse{}
+	errMessage := connector.call(http.MethodPost, "chat.sendMessage", map[string]interface{}{"message": message}, &response)
+	if errMessage != nil {
+		return nil, errMessage
+	}
+	return &response.Message, nil
+}
+
+// NewMessage creates a message for the channel, its ID is set by the server
+func (connector *RESTConnector) NewMessage(channel *models.Channel, text string) *models.Message {
+	return &models.Message{
+		RoomID: channel.ID,
+		Msg:    text,
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+const (
+	defaultRetryMaxAttempts    = 2
+	defaultRetryInitialBackoff = 2 * time.Second
+	defaultRetryMaxBackoff     = 30 * time.Second
+	defaultRetryMultiplier     = 2
+
+	attemptSuccess        = "success"
+	attemptAuthError      = "auth_error"
+	attemptTransientError = "transient_error"
+	attemptPermanentError = "permanent_error"
+)
+
+// realtimeAuthErrors are the fragments of the errors returned by the
+// Rocket.Chat realtime API when the session is not authenticated
+var realtimeAuthErrors = []string{
+	`"error":401`,
+	"must be logged in",
+	"error-not-authorized",
+	"error-unauthorized",
+}
+
+// realtimePermanentErrors are the fragments of the errors returned by the
+// Rocket.Chat realtime API for requests that will never succeed
+var realtimePermanentErrors = []string{
+	`"error":403`,
+	"error-invalid-room",
+	"error-not-allowed",
+	"error-room-not-found",
+}
+
+// RetryInfo - Delivery retry policy configuration
+type RetryInfo struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	Multiplier     float64       `yaml:"multiplier"`
+	Jitter         float64       `yaml:"jitter"`
+	Deadline       time.Duration `yaml:"deadline"`
+}
+
+// maxAttempts returns how many times a notification is sent before giving up
+func (info RetryInfo) maxAttempts() int {
+	if info.MaxAttempts > 0 {
+		return info.MaxAttempts
+	}
+	return defaultRetryMaxAttempts
+}
+
+// initialBackoff returns the wait before the first retry
+func (info RetryInfo) initialBackoff() time.Duration {
+	if info.InitialBackoff > 0 {
+		return info.InitialBackoff
+	}
+	return defaultRetryInitialBackoff
+}
+
+// maxBackoff returns the longest wait between two attempts
+func (info RetryInfo) maxBackoff() time.Duration {
+	if info.MaxBackoff > 0 {
+		return info.MaxBackoff
+	}
+	return defaultRetryMaxBackoff
+}
+
+// multiplier returns the factor applied to the wait after each retry
+func (info RetryInfo) multiplier() float64 {
+	if info.Multiplier > 0 {
+		return info.Multiplier
+	}
+	return defaultRetryMultiplier
+}
+
+// backoff returns the wait before the given retry, starting at 1, without jitter
+func (info RetryInfo) backoff(retry int) time.Duration {
+	backoff := float64(info.initialBackoff())
+	for i := 1; i < retry && backoff < float64(info.maxBackoff()); i++ {
+		backoff *= info.multiplier()
+	}
+	if backoff > float64(info.maxBackoff()) {
+		return info.maxBackoff()
+	}
+	return time.Duration(backoff)
+}
+
+// jittered spreads the wait randomly by up to the jitter fraction, so that
+// the notifications failing together are not retried together
+func (info RetryInfo) jittered(backoff time.Duration) time.Duration {
+	if info.Jitter <= 0 {
+		return backoff
+	}
+	return backoff + time.Duration(float64(backoff)*info.Jitter*(2*rand.Float64()-1))
+}
+
+// checkRetry checks the retry policy values are consistent
+func checkRetry(info RetryInfo) error {
+	if info.MaxAttempts < 0 {
+		return errors.New("retry max attempts must be positive")
+	}
+	if info.InitialBackoff < 0 || info.MaxBackoff < 0 || info.Deadline < 0 {
+		return errors.New("retry backoffs and deadline must be positive")
+	}
+	if info.Multiplier != 0 && info.Multiplier < 1 {
+		return errors.New("retry multiplier must be at least 1")
+	}
+	if info.Jitter < 0 || info.Jitter > 1 {
+		return errors.New("retry jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+// retryError is the last error of a notification that could not be delivered
+type retryError struct {
+	attempts int
+	err      error
+}
+
+func (err *retryError) Error() string {
+	return fmt.Sprintf("after %d attempt(s), last error: %s", err.attempts, err.err)
+}
+
+func (err *retryError) cause() error {
+	return err.err
+}
+
+// classifyError returns the outcome of an attempt failing with err. The
+// session is renewed after an authentication error, the permanent errors are
+// not retried.
+func classifyError(err error) string {
+	if err == nil {
+		return attemptSuccess
+	}
+	switch restErr := rootCause(err).(type) {
+	case *unknownChannelError, *templateError:
+		return attemptPermanentError
+	case *restError:
+		switch {
+		case restErr.StatusCode == http.StatusUnauthorized:
+			return attemptAuthError
+		case restErr.StatusCode == http.StatusRequestTimeout, restErr.StatusCode == http.StatusTooManyRequests:
+			return attemptTransientError
+		case restErr.StatusCode >= 400 && restErr.StatusCode < 500:
+			return attemptPermanentError
+		}
+		return attemptTransientError
+	}
+	for _, fragment := range realtimeAuthErrors {
+		if strings.Contains(err.Error(), fragment) {
+			return attemptAuthError
+		}
+	}
+	for _, fragment := range realtimePermanentErrors {
+		if strings.Contains(err.Error(), fragment) {
+			return attemptPermanentError
+		}
+	}
+	return attemptTransientError
+}
+
+// retry calls f until it succeeds, fails with a permanent error, or the
+// attempts or the deadline of the policy are exhausted. f is given the
+// outcome of the previous attempt.
+func retry(policy RetryInfo, f func(previous string) error) error {
+	start := time.Now()
+	outcome := attemptSuccess
+	for attempt := 1; ; attempt++ {
+		err := f(outcome)
+		outcome = classifyError(err)
+		deliveryAttempts.WithLabelValues(outcome).Inc()
+		if err == nil {
+			return nil
+		}
+
+		if outcome == attemptPermanentError || attempt >= policy.maxAttempts() {
+			return &retryError{attempts: attempt, err: err}
+		}
+
+		sleep := policy.jittered(policy.backoff(attempt))
+		if policy.Deadline > 0 && time.Since(start)+sleep > policy.Deadline {
+			log.Warnf("retry deadline of %v exceeded", policy.Deadline)
+			return &retryError{attempts: attempt, err: err}
+		}
+
+		log.Warnf("retrying in %v after error: %v", sleep, err)
+		time.Sleep(sleep)
+	}
+}
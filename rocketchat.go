@@ -2,47 +2,169 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
 	"github.com/RocketChat/Rocket.Chat.Go.SDK/models"
 	"github.com/RocketChat/Rocket.Chat.Go.SDK/realtime"
 	"github.com/prometheus/alertmanager/template"
 	"github.com/prometheus/common/log"
-	"strings"
+	"github.com/prometheus/common/model"
 )
 
 const (
-	defaultColor       = "#ffffff"
-	severityLabel      = "severity"
-	titleFormat        = "**[ %s ] %s from %s at %s**"
-	attachmentFormat   = "**%s**: %s\n"
-	alertNameFieldName = "alertname"
+	defaultColor   = "#ffffff"
+	severityLabel  = "severity"
+	alertNameLabel = "alertname"
+
+	moreAlertsFormat = "... and %d more alert(s)"
+
+	groupingPerAlert        = "per_alert"
+	groupingPerNotification = "per_notification"
+
+	updateModeNewMessage = "new_message"
+	updateModeEdit       = "edit"
+	updateModeThread     = "thread"
+
+	resolvedColorKey = "resolved"
+	resolvedAtFormat = "\n_Resolved at %s_"
+
+	defaultMaxAttachments = 20
+
+	transportRealtime    = "realtime"
+	transportREST        = "rest"
+	transportIntegration = "integration"
+
+	defaultTimeout = 10 * time.Second
+
+	directMessagePrefix = "@"
 )
 
 // RocketChat is the client interface to Rocket.Chat
 type RocketChat interface {
 	Login(credentials *models.UserCredentials) (*models.User, error)
 	GetChannelID(channelName string) (string, error)
+	GetDirectMessageRoomID(username string) (string, error)
 	SendMessage(message *models.Message) (*models.Message, error)
+	EditMessage(message *models.Message) error
+	SendThreadMessage(message *ThreadMessage) (*models.Message, error)
 	NewMessage(channel *models.Channel, text string) *models.Message
 }
 
-// RocketChatConnector connector and method base
+// ThreadMessage is a message posted as a reply in the thread of another message
+type ThreadMessage struct {
+	*models.Message
+	ThreadID string `json:"tmid"`
+}
+
+// RocketChatConnector connector and method base. Endpoint is the server of
+// the REST API calls made with the session of the realtime client. Timeout
+// bounds the calls to the realtime API.
 type RocketChatConnector struct {
-	Client *realtime.Client
+	Client   *realtime.Client
+	Session  *models.UserCredentials
+	Endpoint url.URL
+	Timeout  time.Duration
+}
+
+// call runs the call to the realtime API and gives up once the timeout is
+// over. The realtime client has no timeout of its own: a call on a dead
+// connection never returns.
+func (connector RocketChatConnector) call(name string, f func() error) error {
+	timeout := connector.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("realtime call %s timed out after %v", name, timeout)
+	}
 }
 
-// Login wraps the Login method
+// Login wraps the Login method and keeps the session for the REST API calls.
+// The credentials are left untouched: the client would otherwise replace their
+// token with the session token, which expires.
 func (connector RocketChatConnector) Login(credentials *models.UserCredentials) (*models.User, error) {
-	return connector.Client.Login(credentials)
+	sessionCredentials := *credentials
+	var user *models.User
+	errLogin := connector.call("login", func() (err error) {
+		user, err = connector.Client.Login(&sessionCredentials)
+		return err
+	})
+	if errLogin != nil {
+		return nil, errLogin
+	}
+	if connector.Session != nil {
+		*connector.Session = models.UserCredentials{ID: sessionCredentials.ID, Token: sessionCredentials.Token}
+	}
+	return user, nil
 }
 
 // GetChannelID wraps the GetChannelId method
 func (connector RocketChatConnector) GetChannelID(channelName string) (string, error) {
-	return connector.Client.GetChannelId(channelName)
+	var channelID string
+	errCall := connector.call("getChannelId", func() (err error) {
+		channelID, err = connector.Client.GetChannelId(channelName)
+		return err
+	})
+	if errCall != nil {
+		return "", errCall
+	}
+	return channelID, nil
+}
+
+// GetDirectMessageRoomID returns the ID of the direct message room with the
+// user. The realtime client has no support for direct messages, so the room
+// is created through the REST API with the session of the realtime client.
+func (connector RocketChatConnector) GetDirectMessageRoomID(username string) (string, error) {
+	return createDirectMessage(restHTTPClient, connector.Endpoint, connector.Session, username)
 }
 
 // SendMessage wraps SendMessage method
 func (connector RocketChatConnector) SendMessage(message *models.Message) (*models.Message, error) {
-	return connector.Client.SendMessage(message)
+	var sent *models.Message
+	errCall := connector.call("sendMessage", func() (err error) {
+		sent, err = connector.Client.SendMessage(message)
+		return err
+	})
+	if errCall != nil {
+		return nil, errCall
+	}
+	return sent, nil
+}
+
+// EditMessage wraps the EditMessage method
+func (connector RocketChatConnector) EditMessage(message *models.Message) error {
+	return connector.call("updateMessage", func() error {
+		return connector.Client.EditMessage(message)
+	})
+}
+
+// Keepalive sets the connection status to online, which fails once the
+// connection or the session is lost
+func (connector RocketChatConnector) Keepalive() error {
+	return connector.call("UserPresence:online", connector.Client.ConnectionOnline)
+}
+
+// SendThreadMessage posts the message in a thread. The realtime client has no
+// support for threads, so the message goes through the REST API with the
+// session of the realtime client.
+func (connector RocketChatConnector) SendThreadMessage(message *ThreadMessage) (*models.Message, error) {
+	response := restMessageResponse{}
+	errCall := restCall(restHTTPClient, connector.Endpoint, connector.Session, http.MethodPost, "chat.sendMessage", map[string]interface{}{"message": message}, &response)
+	if errCall != nil {
+		return nil, errCall
+	}
+	return &response.Message, nil
 }
 
 // NewMessage wraps the NewMessage method
@@ -50,84 +172,343 @@ func (connector RocketChatConnector) NewMessage(channel *models.Channel, text st
 	return connector.Client.NewMessage(channel, text)
 }
 
-// GetRocketChat returns the RocketChat
-func GetRocketChat() (RocketChatConnector, error) {
-
-	rtClient, errClient := realtime.NewClient(&config.Endpoint, false)
+// GetRocketChat returns the RocketChat client of the default server, whose
+// connection state is tracked
+func GetRocketChat() (RocketChat, error) {
+	client, errClient := newRocketChat(config.defaultServer())
 	if errClient != nil {
-		return RocketChatConnector{}, errClient
+		return nil, errClient
+	}
+	trackClient(defaultServerName, client)
+	return client, nil
+}
+
+// newRocketChat returns the RocketChat client of the transport of the
+// server, guarded for the concurrent webhook requests
+func newRocketChat(server ServerInfo) (RocketChat, error) {
+
+	switch server.Transport {
+	case transportREST:
+		return newSharedClient(NewRESTConnector(server.Endpoint, server.timeout()), server.maxConcurrentSends()), nil
+	case transportIntegration:
+		return newSharedClient(NewIntegrationConnector(server.Integrations, server.timeout()), server.maxConcurrentSends()), nil
 	}
 
-	return RocketChatConnector{Client: rtClient}, nil
+	endpoint := server.Endpoint
+	rtClient, errClient := newRealtimeClient(&endpoint)
+	if errClient != nil {
+		return nil, errClient
+	}
+	connector := RocketChatConnector{Client: rtClient, Session: &models.UserCredentials{}, Endpoint: server.Endpoint, Timeout: server.timeout()}
+	return newSharedClient(connector, server.maxConcurrentSends()), nil
 
 }
 
-// AuthenticateRocketChatClient performs login on the client
+// AuthenticateRocketChatClient performs login on the client of the default server
 func AuthenticateRocketChatClient(connector RocketChat) error {
-	_, errUser := connector.Login(&config.Credentials)
+	return authenticateServer(config.defaultServer(), connector)
+}
+
+// authenticateServer performs login on the client with the account of the server
+func authenticateServer(server ServerInfo, connector RocketChat) error {
+	loginAttempts.WithLabelValues(server.Name).Inc()
+	_, errUser := connector.Login(&server.Credentials.UserCredentials)
+	if errUser != nil {
+		loginFailures.WithLabelValues(server.Name).Inc()
+	}
+	health.recordLogin(server.Name, errUser)
 	return errUser
 }
 
-func formatMessage(connector RocketChat, channel *models.Channel, alert template.Alert, receiver string) *models.Message {
-	severity := alert.Labels[severityLabel]
+// authenticateServerOrLog performs login on the client of the server and logs
+// the failure
+func authenticateServerOrLog(server ServerInfo, connector RocketChat) {
+	if errAuthentication := authenticateServer(server, connector); errAuthentication != nil {
+		log.Errorf("Error authenticating RocketChat client of server %s: %v", server.Name, errAuthentication)
+	}
+}
 
-	title := fmt.Sprintf(titleFormat, alert.Status, alert.Labels[alertNameFieldName], receiver, alert.StartsAt)
-	message := connector.NewMessage(channel, title)
+// alertColor returns the attachment color matching the severity of the
+// alert, or the resolved color if one is configured and the alert is resolved
+func (config Config) alertColor(alert template.Alert) string {
+	if color, colorExists := config.SeverityColors[resolvedColorKey]; colorExists && alert.Status == string(model.AlertResolved) {
+		return color
+	}
+	if color, colorExists := config.SeverityColors[alert.Labels[severityLabel]]; colorExists {
+		return color
+	}
+	return defaultColor
+}
 
-	var usedColor string
-	if color, colorExists := config.SeverityColors[severity]; colorExists {
-		usedColor = color
-	} else {
-		usedColor = defaultColor
+// formatText renders the message title followed by the optional text
+func (config Config) formatText(titleTemplate, defaultTitle string, templateData *TemplateData) (string, error) {
+	title, errTitle := config.Templates.executeTemplate(titleTemplate, defaultTitle, templateData)
+	if errTitle != nil {
+		return "", fmt.Errorf("error executing title template: %v", errTitle)
+	}
+	text, errText := config.Templates.executeTemplate(config.Templates.Text, "", templateData)
+	if errText != nil {
+		return "", fmt.Errorf("error executing text template: %v", errText)
+	}
+	if text != "" {
+		title = title + "\n" + text
+	}
+	return title, nil
+}
+
+// formatAttachment renders the attachment of one alert
+func (config Config) formatAttachment(templateData *TemplateData) (models.Attachment, error) {
+	attachmentText, errAttachment := config.Templates.executeTemplate(config.Templates.Attachment, defaultAttachmentTemplate, templateData)
+	if errAttachment != nil {
+		return models.Attachment{}, fmt.Errorf("error executing attachment template: %v", errAttachment)
 	}
 
-	var attachmentBuilder strings.Builder
+	return models.Attachment{
+		Color: config.alertColor(templateData.Alert),
+		Text:  attachmentText,
+	}, nil
+}
+
+// apply sets the configured alias, emoji and avatar on the message
+func (info MessageInfo) apply(message *models.Message) {
+	message.PostMessage.Alias = info.Alias
+	message.PostMessage.Emoji = info.Emoji
+	message.PostMessage.Avatar = info.Avatar
+}
 
-	for _, label := range alert.Labels.SortedPairs() {
-		attachmentBuilder.WriteString(fmt.Sprintf(attachmentFormat, label.Name, label.Value))
+// formatThreadMessage makes message a reply in the thread of the parent message
+func formatThreadMessage(message *models.Message, parentID string) *ThreadMessage {
+	return &ThreadMessage{Message: message, ThreadID: parentID}
+}
+
+func (config Config) formatMessage(connector RocketChat, channel *models.Channel, alert template.Alert, data template.Data) (*models.Message, error) {
+	templateData := &TemplateData{Data: data, Alert: alert}
+
+	title, errTitle := config.formatText(config.Templates.Title, defaultTitleTemplate, templateData)
+	if errTitle != nil {
+		return nil, errTitle
+	}
+	attachment, errAttachment := config.formatAttachment(templateData)
+	if errAttachment != nil {
+		return nil, errAttachment
 	}
-	for _, annotation := range alert.Annotations.SortedPairs() {
-		attachmentBuilder.WriteString(fmt.Sprintf(attachmentFormat, annotation.Name, annotation.Value))
+
+	message := connector.NewMessage(channel, withMentions(config.mentions(template.Alerts{alert}, channel.ID), title))
+	message.PostMessage.Attachments = []models.Attachment{attachment}
+	config.Message.apply(message)
+
+	return message, nil
+}
+
+// formatGroupMessage builds a single message for all the alerts of the
+// notification, with one attachment per alert up to the configured maximum
+func (config Config) formatGroupMessage(connector RocketChat, channel *models.Channel, data template.Data) (*models.Message, error) {
+	title, errTitle := config.formatText(config.Templates.GroupTitle, defaultGroupTitleTemplate, &TemplateData{Data: data})
+	if errTitle != nil {
+		return nil, errTitle
 	}
 
-	message.PostMessage.Attachments = []models.Attachment{
-		{
-			Color: usedColor,
-			Text:  attachmentBuilder.String(),
-		},
+	maxAttachments := config.maxAttachments()
+	attachments := []models.Attachment{}
+	for i, alert := range data.Alerts {
+		if i >= maxAttachments {
+			attachments = append(attachments, models.Attachment{
+				Color: defaultColor,
+				Text:  fmt.Sprintf(moreAlertsFormat, len(data.Alerts)-maxAttachments),
+			})
+			break
+		}
+
+		attachment, errAttachment := config.formatAttachment(&TemplateData{Data: data, Alert: alert})
+		if errAttachment != nil {
+			return nil, errAttachment
+		}
+		attachments = append(attachments, attachment)
 	}
 
-	return message
+	message := connector.NewMessage(channel, withMentions(config.mentions(data.Alerts, channel.ID), title))
+	message.PostMessage.Attachments = attachments
+	config.Message.apply(message)
+
+	return message, nil
 }
 
-// SendNotification connects to RocketChat server, authenticates the user and sends the notification
-func SendNotification(connector RocketChat, data template.Data) error {
+// sendAlertMessage posts the message of an alert. When update_mode is edit or
+// thread, the first message posted for the alert is remembered and the
+// repeats and resolution of the alert respectively edit it or are posted as
+// replies in its thread. The message is forgotten once the alert is resolved.
+func (config Config) sendAlertMessage(connector RocketChat, alert template.Alert, message *models.Message) error {
+	if config.UpdateMode != updateModeEdit && config.UpdateMode != updateModeThread {
+		_, errMessage := connector.SendMessage(message)
+		return errMessage
+	}
 
-	channelName := config.Channel.DefaultChannelName
-	if val, ok := data.CommonLabels["channel_name"]; ok {
-		channelName = val
+	resolved := alert.Status == string(model.AlertResolved)
+	if resolved {
+		message.Msg += fmt.Sprintf(resolvedAtFormat, alert.EndsAt)
 	}
 
-	if channelName == "" {
+	key := alertKey(alert, message.RoomID)
+	if entry, found := alertMessages.Get(key); found {
+		var errUpdate error
+		if config.UpdateMode == updateModeThread {
+			_, errUpdate = connector.SendThreadMessage(formatThreadMessage(message, entry.MessageID))
+		} else {
+			message.ID = entry.MessageID
+			errUpdate = connector.EditMessage(message)
+		}
+		if errUpdate == nil {
+			var errState error
+			if resolved {
+				errState = alertMessages.Delete(key)
+			} else {
+				errState = alertMessages.Set(key, config.newStateEntry(entry.MessageID, entry.RoomID))
+			}
+			if errState != nil {
+				log.Errorf("Error to update message state: %v", errState)
+			}
+			return nil
+		}
+		log.Warnf("Error to update message %s, posting a new one: %v", entry.MessageID, errUpdate)
+	}
+
+	sent, errMessage := connector.SendMessage(message)
+	if errMessage != nil {
+		return errMessage
+	}
+	if !resolved {
+		messageID := message.ID
+		if sent != nil && sent.ID != "" {
+			messageID = sent.ID
+		}
+		if errState := alertMessages.Set(key, config.newStateEntry(messageID, message.RoomID)); errState != nil {
+			log.Errorf("Error to store message state: %v", errState)
+		}
+	}
+	return nil
+}
+
+// SendNotification connects to RocketChat server, authenticates the user and
+// sends the notification. connector is the client of the default server, the
+// alerts routed to the named servers are sent with their own client. It
+// returns the result of the delivery to each channel.
+func (config Config) SendNotification(connector RocketChat, data template.Data) ([]ChannelResult, error) {
+	return config.sendBatches(connector, config.batchAlerts(data), data)
+}
+
+// sendBatches sends the batches of alerts of the notification to their
+// channel. It returns the result of the delivery to each channel, in the
+// order of the batches.
+func (config Config) sendBatches(connector RocketChat, batches []*channelBatch, data template.Data) ([]ChannelResult, error) {
+	if len(batches) == 0 {
 		log.Error("Exception: Channel name not found. Please specify a default_channel_name in the configuration.")
-	} else {
-		channelID, errRoom := connector.GetChannelID(channelName)
-		if errRoom != nil {
-			log.Errorf("Error to get room ID: %v", errRoom)
-			return errRoom
+		return nil, nil
+	}
+
+	log.Infof("Alerts: Status=%s, GroupLabels=%v, CommonLabels=%v", data.Status, data.GroupLabels, data.CommonLabels)
+	results := make([]ChannelResult, 0, len(batches))
+	var errs []error
+	for _, batch := range batches {
+		log.Infof("Routing %d alert(s) to channel %s of server %s (routes %v)", len(batch.alerts), batch.channel, batch.server, batch.routes)
+		for _, route := range batch.routes {
+			routedNotifications.WithLabelValues(route, batch.channel).Inc()
 		}
-		channel := &models.Channel{ID: channelID}
 
-		log.Infof("Alerts: Status=%s, GroupLabels=%v, CommonLabels=%v", data.Status, data.GroupLabels, data.CommonLabels)
-		for _, alert := range data.Alerts {
+		batchConnector := connector
+		if batch.server != defaultServerName {
+			batchConnector = config.client(batch.server)
+		}
+		var errBatch error
+		if batchConnector == nil {
+			errBatch = errNoServerClient
+		} else {
+			errBatch = config.sendBatch(batchConnector, batch, data)
+		}
+		if errBatch != nil {
+			errs = append(errs, errBatch)
+		}
+		result := newChannelResult(batch.channel, errBatch)
+		if batch.server != defaultServerName {
+			result.Server = batch.server
+		}
+		results = append(results, result)
+	}
+	if len(errs) > 0 {
+		return results, &notificationError{results: results, errs: errs}
+	}
+	return results, nil
+}
 
-			message := formatMessage(connector, channel, alert, data.Receiver)
-			_, errMessage := connector.SendMessage(message)
-			if errMessage != nil {
-				log.Infof("Error to send message: %v", errMessage)
-				return errMessage
-			}
+// sendBatch sends the alerts routed to a channel
+func (config Config) sendBatch(connector RocketChat, batch *channelBatch, data template.Data) error {
+	channelID, errRoom := destinationRoomID(connector, batch.channel)
+	if errRoom != nil {
+		log.Errorf("Error to get room ID: %v", errRoom)
+		if _, unknown := errRoom.(*unknownChannelError); !unknown && classifyError(errRoom) == attemptPermanentError {
+			return &unknownChannelError{channel: batch.channel, err: errRoom}
 		}
+		return errRoom
+	}
+	channel := &models.Channel{ID: channelID}
+
+	if config.GroupingMode == groupingPerNotification {
+		batchData := data
+		batchData.Alerts = batch.alerts
+		message, errFormat := config.formatGroupMessage(connector, channel, batchData)
+		if errFormat != nil {
+			log.Errorf("Error to format message: %v", errFormat)
+			return &templateError{err: errFormat}
+		}
+		start := time.Now()
+		_, errMessage := connector.SendMessage(message)
+		observeSend(batch.server, batch.channel, start, errMessage)
+		if errMessage != nil {
+			log.Infof("Error to send message: %v", errMessage)
+			return errMessage
+		}
+		config.recordMentions(batch.alerts, channelID)
+		return nil
+	}
+
+	// The alerts delivered are removed from the batch, so that only the
+	// others are sent again
+	for i, alert := range batch.alerts {
+		message, errFormat := config.formatMessage(connector, channel, alert, data)
+		if errFormat != nil {
+			log.Errorf("Error to format message: %v", errFormat)
+			batch.alerts = batch.alerts[i:]
+			return &templateError{err: errFormat}
+		}
+		start := time.Now()
+		errMessage := config.sendAlertMessage(connector, alert, message)
+		observeSend(batch.server, batch.channel, start, errMessage)
+		if errMessage != nil {
+			log.Infof("Error to send message: %v", errMessage)
+			batch.alerts = batch.alerts[i:]
+			return errMessage
+		}
+		config.recordMentions(template.Alerts{alert}, channelID)
 	}
 	return nil
 }
+
+// destinationRoomID returns the ID of the room of the destination: the direct
+// message room with the user for the destinations starting with @, the
+// channel otherwise
+func destinationRoomID(connector RocketChat, destination string) (string, error) {
+	if strings.HasPrefix(destination, directMessagePrefix) {
+		return connector.GetDirectMessageRoomID(strings.TrimPrefix(destination, directMessagePrefix))
+	}
+	return connector.GetChannelID(destination)
+}
+
+// observeSend records the latency and the outcome of a message sent to the
+// channel of the server
+func observeSend(server, channel string, start time.Time, errMessage error) {
+	sendDuration.Observe(time.Since(start).Seconds())
+	if errMessage != nil {
+		messagesFailed.WithLabelValues(server, channel).Inc()
+	} else {
+		messagesSent.WithLabelValues(server, channel).Inc()
+	}
+}
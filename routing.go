@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/alertmanager/types"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	defaultChannelLabel = "channel_name"
+	channelLabelRoute   = "channel_label"
+	defaultRoute        = "default"
+)
+
+// Route - Label based routing rule
+type Route struct {
+	Name     string            `yaml:"name"`
+	Match    map[string]string `yaml:"match"`
+	MatchRE  map[string]string `yaml:"match_re"`
+	Channels []string          `yaml:"channels"`
+	Continue bool              `yaml:"continue"`
+	Server   string            `yaml:"server"`
+
+	matchers types.Matchers
+}
+
+// routedChannel is a destination channel, the server it is on if the route
+// selects one, and the route that selected it
+type routedChannel struct {
+	channel string
+	server  string
+	route   string
+}
+
+// routeName returns the name used to identify the route in logs and metrics
+func (route Route) routeName(index int) string {
+	if route.Name != "" {
+		return route.Name
+	}
+	return strconv.Itoa(index)
+}
+
+// loadRoutes validates the routes and builds their label matchers
+func loadRoutes(routes []Route) error {
+	for i := range routes {
+		route := &routes[i]
+		if len(route.Channels) == 0 {
+			return fmt.Errorf("route %s: no channels provided", route.routeName(i))
+		}
+
+		matchers, errMatchers := newMatchers(route.Match, route.MatchRE)
+		if errMatchers != nil {
+			return fmt.Errorf("route %s: %v", route.routeName(i), errMatchers)
+		}
+		route.matchers = matchers
+	}
+	return nil
+}
+
+// newMatchers builds the label matchers requiring label equality for match
+// and a regular expression matching the whole label value for matchRE
+func newMatchers(match, matchRE map[string]string) (types.Matchers, error) {
+	matchers := types.Matchers{}
+	for name, value := range match {
+		matchers = append(matchers, types.NewMatcher(model.LabelName(name), value))
+	}
+	for name, value := range matchRE {
+		re, errRegex := regexp.Compile("^(?:" + value + ")$")
+		if errRegex != nil {
+			return nil, fmt.Errorf("invalid regular expression %q", value)
+		}
+		matchers = append(matchers, types.NewRegexMatcher(model.LabelName(name), re))
+	}
+	for _, matcher := range matchers {
+		if errMatcher := matcher.Validate(); errMatcher != nil {
+			return nil, errMatcher
+		}
+	}
+	return types.NewMatchers(matchers...), nil
+}
+
+// newLabelSet converts the labels for the label matchers
+func newLabelSet(labels template.KV) model.LabelSet {
+	set := make(model.LabelSet, len(labels))
+	for name, value := range labels {
+		set[model.LabelName(name)] = model.LabelValue(value)
+	}
+	return set
+}
+
+// channelBatch holds the alerts of a notification routed to the same channel
+// of the same server
+type channelBatch struct {
+	channel string
+	server  string
+	routes  []string
+	alerts  template.Alerts
+}
+
+// key identifies the channel of the batch across the servers
+func (batch *channelBatch) key() string {
+	return batch.server + "/" + batch.channel
+}
+
+// routeChannels returns the channels the labels are routed to. The channel
+// label takes precedence over the routes, which are evaluated in order until
+// one of them matches without continue. Unmatched labels go to the default
+// channel.
+func (config Config) routeChannels(labels template.KV) []routedChannel {
+	if channelName, ok := labels[config.Channel.labelName()]; ok && channelName != "" {
+		return []routedChannel{{channel: channelName, route: channelLabelRoute}}
+	}
+
+	labelSet := newLabelSet(labels)
+
+	var channels []routedChannel
+	seen := map[string]bool{}
+	for i, route := range config.Routes {
+		if !route.matchers.Match(labelSet) {
+			continue
+		}
+		for _, channelName := range route.Channels {
+			key := route.Server + "/" + channelName
+			if !seen[key] {
+				seen[key] = true
+				channels = append(channels, routedChannel{channel: channelName, server: route.Server, route: route.routeName(i)})
+			}
+		}
+		if !route.Continue {
+			break
+		}
+	}
+
+	if len(channels) == 0 && config.Channel.DefaultChannelName != "" {
+		channels = append(channels, routedChannel{channel: config.Channel.DefaultChannelName, route: defaultRoute})
+	}
+
+	return channels
+}
+
+// batchAlerts routes every alert of the notification on its own labels and
+// groups the alerts by destination channel, in order of first appearance. The
+// alerts go to the server of their route, or else to the server of the
+// profile or of the receiver of the notification.
+func (config Config) batchAlerts(data template.Data) []*channelBatch {
+	var batches []*channelBatch
+	byChannel := map[string]*channelBatch{}
+	receiverServer := config.profileServer
+	if receiverServer == "" {
+		receiverServer = config.receiverServer(data.Receiver)
+	}
+
+	for _, alert := range data.Alerts {
+		// Alert labels take precedence over the common labels of the group
+		labels := template.KV{}
+		for name, value := range data.CommonLabels {
+			labels[name] = value
+		}
+		for name, value := range alert.Labels {
+			labels[name] = value
+		}
+
+		channels := config.routeChannels(labels)
+		if len(channels) == 0 {
+			log.Warnf("No channel found for alert %s, dropping it", alert.Labels[alertNameLabel])
+		}
+		for _, routed := range channels {
+			server := routed.server
+			if server == "" {
+				server = receiverServer
+			}
+			batch := &channelBatch{channel: routed.channel, server: server}
+			if existing, exists := byChannel[batch.key()]; exists {
+				batch = existing
+			} else {
+				byChannel[batch.key()] = batch
+				batches = append(batches, batch)
+			}
+			if !containsString(batch.routes, routed.route) {
+				batch.routes = append(batch.routes, routed.route)
+			}
+			batch.alerts = append(batch.alerts, alert)
+		}
+	}
+
+	return batches
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/RocketChat/Rocket.Chat.Go.SDK/models"
+)
+
+var envVariableRegexp = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// CredentialsInfo - Rocket.Chat user credentials configuration, the password
+// and the token can be read from files
+type CredentialsInfo struct {
+	models.UserCredentials `yaml:",inline"`
+
+	PasswordFile string `yaml:"password_file"`
+	TokenFile    string `yaml:"token_file"`
+}
+
+// expandEnv replaces the ${VAR} references in value by the value of the
+// environment variables, which must be set
+func expandEnv(value string) (string, error) {
+	var errExpand error
+	expanded := envVariableRegexp.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envVariableRegexp.FindStringSubmatch(reference)[1]
+		envValue, found := os.LookupEnv(name)
+		if !found && errExpand == nil {
+			errExpand = fmt.Errorf("environment variable %s not set", name)
+		}
+		return envValue
+	})
+	return expanded, errExpand
+}
+
+// readSecretFile returns the content of the file without its trailing newline
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// resolveSecrets reads the secret files and expands the environment variables
+// of the credentials, the endpoint and the integration URLs of every server
+func resolveSecrets(config *Config) error {
+	if err := resolveServerSecrets(&config.Credentials, &config.Endpoint, config.Integrations); err != nil {
+		return err
+	}
+	for i := range config.Servers {
+		server := &config.Servers[i]
+		if err := resolveServerSecrets(&server.Credentials, &server.Endpoint, server.Integrations); err != nil {
+			return fmt.Errorf("server %s: %v", server.Name, err)
+		}
+	}
+	return nil
+}
+
+// resolveServerSecrets resolves the secrets of a server. The environment
+// variables are expanded in the values of the configuration file only, the
+// content of the secret files is used as is.
+func resolveServerSecrets(credentials *CredentialsInfo, endpoint *url.URL, integrations map[string]string) error {
+	values := []*string{
+		&credentials.ID,
+		&credentials.Token,
+		&credentials.Email,
+		&credentials.Name,
+		&credentials.Password,
+		&endpoint.Scheme,
+		&endpoint.Host,
+		&endpoint.Path,
+	}
+	for _, value := range values {
+		expanded, err := expandEnv(*value)
+		if err != nil {
+			return err
+		}
+		*value = expanded
+	}
+
+	for channelName, integrationURL := range integrations {
+		expanded, err := expandEnv(integrationURL)
+		if err != nil {
+			return fmt.Errorf("integration URL for channel %s: %v", channelName, err)
+		}
+		integrations[channelName] = expanded
+	}
+
+	if credentials.PasswordFile != "" {
+		password, err := readSecretFile(credentials.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("error reading password file: %v", err)
+		}
+		credentials.Password = password
+	}
+	if credentials.TokenFile != "" {
+		token, err := readSecretFile(credentials.TokenFile)
+		if err != nil {
+			return fmt.Errorf("error reading token file: %v", err)
+		}
+		credentials.Token = token
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+const defaultServerName = "default"
+
+// errNoServerClient is returned when a server has no client, which happens
+// when its client could not be created
+var errNoServerClient = errors.New("no client for the server")
+
+// ServerInfo - Rocket.Chat server and account configuration. The top level
+// settings of the configuration describe the default server.
+type ServerInfo struct {
+	Name               string            `yaml:"name"`
+	Endpoint           url.URL           `yaml:"endpoint"`
+	Transport          string            `yaml:"transport"`
+	Timeout            time.Duration     `yaml:"timeout"`
+	Credentials        CredentialsInfo   `yaml:"credentials"`
+	Integrations       map[string]string `yaml:"integrations"`
+	MaxConcurrentSends int               `yaml:"max_concurrent_sends"`
+	Receivers          []string          `yaml:"receivers"`
+}
+
+// serverClients are the clients of the named servers, the client of the
+// default server is rocketChat
+var serverClients = map[string]RocketChat{}
+
+// defaultServer returns the server described by the top level settings
+func (config Config) defaultServer() ServerInfo {
+	return ServerInfo{
+		Name:               defaultServerName,
+		Endpoint:           config.Endpoint,
+		Transport:          config.Transport,
+		Timeout:            config.Timeout,
+		Credentials:        config.Credentials,
+		Integrations:       config.Integrations,
+		MaxConcurrentSends: config.MaxConcurrentSends,
+	}
+}
+
+// servers returns the default server followed by the named servers
+func (config Config) servers() []ServerInfo {
+	return append([]ServerInfo{config.defaultServer()}, config.Servers...)
+}
+
+// server returns the server of the given name
+func (config Config) server(name string) (ServerInfo, bool) {
+	for _, server := range config.servers() {
+		if server.Name == name {
+			return server, true
+		}
+	}
+	return ServerInfo{}, false
+}
+
+// receiverServer returns the name of the server the notifications of the
+// receiver are sent to: the server listing the receiver, or the default one
+func (config Config) receiverServer(receiver string) string {
+	for _, server := range config.Servers {
+		if containsString(server.Receivers, receiver) {
+			return server.Name
+		}
+	}
+	return defaultServerName
+}
+
+// timeout returns the timeout of the calls to the Rocket.Chat REST API
+func (server ServerInfo) timeout() time.Duration {
+	if server.Timeout > 0 {
+		return server.Timeout
+	}
+	return defaultTimeout
+}
+
+// maxConcurrentSends returns how many calls to Rocket.Chat may run at once.
+// The realtime client can't be used concurrently, its calls run one by one.
+func (server ServerInfo) maxConcurrentSends() int {
+	if server.MaxConcurrentSends > 0 {
+		return server.MaxConcurrentSends
+	}
+	if server.isRealtime() {
+		return 1
+	}
+	return defaultMaxConcurrentSends
+}
+
+// isRealtime returns whether the server is reached through the realtime API
+func (server ServerInfo) isRealtime() bool {
+	return server.Transport == "" || server.Transport == transportRealtime
+}
+
+// sameConnection returns whether the two servers are reached the same way, in
+// which case the client of one can be used for the other
+func (server ServerInfo) sameConnection(other ServerInfo) bool {
+	return server.Transport == other.Transport &&
+		server.Endpoint == other.Endpoint &&
+		server.Timeout == other.Timeout &&
+		server.MaxConcurrentSends == other.MaxConcurrentSends &&
+		reflect.DeepEqual(server.Integrations, other.Integrations)
+}
+
+// checkServer checks the connection settings and the account of the server
+func checkServer(server ServerInfo) error {
+	if server.isRealtime() && server.MaxConcurrentSends > 1 {
+		return errors.New("max concurrent sends must be 1 with the realtime transport")
+	}
+	switch server.Transport {
+	case "", transportRealtime, transportREST:
+		return checkCredentials(server)
+	case transportIntegration:
+		return checkIntegrations(server)
+	}
+	return fmt.Errorf("unknown transport %q", server.Transport)
+}
+
+// checkServers checks the named servers, the routes and the receivers they
+// are selected by
+func checkServers(config *Config) error {
+	names := map[string]bool{defaultServerName: true}
+	receivers := map[string]string{}
+	for i, server := range config.Servers {
+		if server.Name == "" {
+			return fmt.Errorf("server %d: no name provided", i)
+		}
+		if server.Name == defaultServerName {
+			return fmt.Errorf("server name %q is reserved for the top level server", defaultServerName)
+		}
+		if names[server.Name] {
+			return fmt.Errorf("server %s defined more than once", server.Name)
+		}
+		names[server.Name] = true
+		if err := checkServer(server); err != nil {
+			return fmt.Errorf("server %s: %v", server.Name, err)
+		}
+		if server.MaxConcurrentSends < 0 {
+			return fmt.Errorf("server %s: max concurrent sends must be positive", server.Name)
+		}
+		for _, receiver := range server.Receivers {
+			if other, exists := receivers[receiver]; exists {
+				return fmt.Errorf("receiver %s sent to both servers %s and %s", receiver, other, server.Name)
+			}
+			receivers[receiver] = server.Name
+		}
+	}
+	for i, route := range config.Routes {
+		if route.Server != "" && !names[route.Server] {
+			return fmt.Errorf("route %s: unknown server %s", route.routeName(i), route.Server)
+		}
+	}
+	return nil
+}
+
+// serverClient returns the client of the server of the given name
+func serverClient(name string) RocketChat {
+	if name == "" || name == defaultServerName {
+		return rocketChat
+	}
+	return serverClients[name]
+}
+
+// client returns the client of the server of the given name, the one of the
+// snapshot if the configuration is one
+func (config Config) client(name string) RocketChat {
+	if config.clients != nil {
+		return config.clients[name]
+	}
+	return serverClient(name)
+}
+
+// setServerClient makes client the client of the server of the given name
+func setServerClient(name string, client RocketChat) {
+	if name == "" || name == defaultServerName {
+		rocketChat = client
+		return
+	}
+	serverClients[name] = client
+}
+
+// swapServerClient makes client the client of the server of the given name
+// and returns the previous one, to be closed once the lock is released
+func swapServerClient(name string, client RocketChat) RocketChat {
+	previous := serverClient(name)
+	setServerClient(name, client)
+	trackClient(name, client)
+	return previous
+}
+
+// trackClient reports the connection state of the client of the server if
+// it is a realtime one
+func trackClient(name string, client RocketChat) {
+	if rtConnector, ok := realtimeConnector(client); ok {
+		trackConnectionState(name, rtConnector.Client)
+	} else {
+		untrackConnection(name)
+	}
+}
+
+// connectServers creates and authenticates the clients of the named servers
+func connectServers() error {
+	for _, server := range config.Servers {
+		client, errClient := newRocketChat(server)
+		if errClient != nil {
+			return fmt.Errorf("server %s: %v", server.Name, errClient)
+		}
+		closeRocketChat(swapServerClient(server.Name, client))
+		authenticateServerOrLog(server, client)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	spoolFileExtension = ".json"
+
+	defaultSpoolMaxAge   = 24 * time.Hour
+	defaultSpoolInterval = 30 * time.Second
+)
+
+// SpoolInfo - Undelivered notifications spool configuration
+type SpoolInfo struct {
+	Directory string        `yaml:"directory"`
+	MaxAge    time.Duration `yaml:"max_age"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+// maxAge returns how long an undelivered notification is kept
+func (info SpoolInfo) maxAge() time.Duration {
+	if info.MaxAge > 0 {
+		return info.MaxAge
+	}
+	return defaultSpoolMaxAge
+}
+
+// interval returns how often the delivery of the spooled notifications is retried
+func (info SpoolInfo) interval() time.Duration {
+	if info.Interval > 0 {
+		return info.Interval
+	}
+	return defaultSpoolInterval
+}
+
+// spooledNotification is a notification waiting in the spool, the profile of
+// the webhook path it was posted to, and the batches of alerts that were not
+// delivered yet
+type spooledNotification struct {
+	Profile   string         `json:"profile,omitempty"`
+	Data      template.Data  `json:"data"`
+	Batches   []spooledBatch `json:"batches,omitempty"`
+	Created   time.Time      `json:"created"`
+	Attempts  int            `json:"attempts"`
+	LastError string         `json:"last_error"`
+}
+
+// spooledBatch is a batch of alerts routed to a channel waiting in the spool
+type spooledBatch struct {
+	Channel string          `json:"channel"`
+	Server  string          `json:"server"`
+	Routes  []string        `json:"routes,omitempty"`
+	Alerts  template.Alerts `json:"alerts"`
+}
+
+// newSpooledBatches returns the batches to write in the spool
+func newSpooledBatches(batches []*channelBatch) []spooledBatch {
+	spooled := make([]spooledBatch, 0, len(batches))
+	for _, batch := range batches {
+		spooled = append(spooled, spooledBatch{Channel: batch.channel, Server: batch.server, Routes: batch.routes, Alerts: batch.alerts})
+	}
+	return spooled
+}
+
+// batches returns the batches left to deliver, nil if the notification was
+// spooled without its batches and must be routed again
+func (item spooledNotification) batches() []*channelBatch {
+	if len(item.Batches) == 0 {
+		return nil
+	}
+	batches := make([]*channelBatch, 0, len(item.Batches))
+	for _, batch := range item.Batches {
+		batches = append(batches, &channelBatch{channel: batch.Channel, server: batch.Server, routes: batch.Routes, alerts: batch.Alerts})
+	}
+	return batches
+}
+
+// spool keeps the notifications that could not be delivered in a directory,
+// one file per notification, until they are delivered or too old
+type spool struct {
+	directory string
+	maxAge    time.Duration
+
+	// mutex guards the files of the spool, replaying serializes the replays
+	// so that the files are not delivered twice
+	mutex     sync.Mutex
+	sequence  uint64
+	replaying sync.Mutex
+}
+
+// notificationSpool is the spool of the webhook, nil when undelivered
+// notifications are not spooled
+var notificationSpool *spool
+
+func newSpool(directory string, maxAge time.Duration) (*spool, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	s := &spool{directory: directory, maxAge: maxAge}
+	spoolSize.Set(float64(len(s.files())))
+	return s, nil
+}
+
+// add writes the notification in the spool, with the batches of alerts that
+// were not delivered
+func (s *spool) add(profile string, data template.Data, batches []*channelBatch, errSend error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.sequence++
+	// The file names sort in the order the notifications were spooled
+	name := fmt.Sprintf("%020d-%06d%s", now.UnixNano(), s.sequence%1000000, spoolFileExtension)
+	item := spooledNotification{
+		Profile:   profile,
+		Data:      data,
+		Batches:   newSpooledBatches(batches),
+		Created:   now,
+		Attempts:  1,
+		LastError: errSend.Error(),
+	}
+	if err := s.write(filepath.Join(s.directory, name), item); err != nil {
+		return err
+	}
+
+	spooledNotifications.Inc()
+	spoolSize.Inc()
+	return nil
+}
+
+// write atomically replaces the file with the item
+func (s *spool) write(path string, item spooledNotification) error {
+	content, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// files returns the paths of the spooled notifications, oldest first
+func (s *spool) files() []string {
+	infos, err := ioutil.ReadDir(s.directory)
+	if err != nil {
+		log.Errorf("Error reading spool directory: %v", err)
+		return nil
+	}
+	var files []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), spoolFileExtension) {
+			files = append(files, filepath.Join(s.directory, info.Name()))
+		}
+	}
+	return files
+}
+
+// read returns the spooled notification of the file
+func (s *spool) read(path string) (spooledNotification, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item := spooledNotification{}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return item, err
+	}
+	return item, json.Unmarshal(content, &item)
+}
+
+// update replaces the spooled notification of the file
+func (s *spool) update(path string, item spooledNotification) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(path, item)
+}
+
+// remove deletes the file of a spooled notification
+func (s *spool) remove(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	os.Remove(path)
+}
+
+// list returns the paths of the spooled notifications, oldest first
+func (s *spool) list() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.files()
+}
+
+// replay delivers the spooled notifications in order. It discards the ones
+// older than the maximum age or rejected by Rocket.Chat and stops at the first
+// other failure, to retry later. The spool is only locked while its files are
+// read and written, not while the notifications are delivered, so that
+// notifications can be spooled meanwhile.
+func (s *spool) replay() {
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+
+	defer func() { spoolSize.Set(float64(len(s.list()))) }()
+
+	for _, path := range s.list() {
+		item, err := s.read(path)
+		if err != nil {
+			log.Errorf("Discarding unreadable spooled notification %s: %v", path, err)
+			s.remove(path)
+			discardedNotifications.Inc()
+			continue
+		}
+
+		if time.Since(item.Created) > s.maxAge {
+			log.Warnf("Discarding spooled notification %s after %d attempts, last error: %s", path, item.Attempts, item.LastError)
+			s.remove(path)
+			discardedNotifications.Inc()
+			continue
+		}
+
+		_, undelivered, errSend := deliver(item.Profile, item.Data, item.batches())
+		if errSend != nil && classifyError(errSend) == attemptPermanentError {
+			log.Warnf("Discarding spooled notification %s rejected by Rocket.Chat: %v", path, errSend)
+			s.remove(path)
+			discardedNotifications.Inc()
+			continue
+		}
+		if errSend != nil {
+			item.Attempts++
+			item.LastError = errSend.Error()
+			item.Batches = newSpooledBatches(undelivered)
+			if errWrite := s.update(path, item); errWrite != nil {
+				log.Errorf("Error updating spooled notification %s: %v", path, errWrite)
+			}
+			log.Warnf("Error replaying spooled notification %s, will retry: %v", path, errSend)
+			return
+		}
+
+		s.remove(path)
+		replayedNotifications.Inc()
+		log.Infof("Replayed spooled notification %s after %d attempts", path, item.Attempts)
+	}
+}
+
+// run periodically replays the spooled notifications
+func (s *spool) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.replay()
+	}
+}
+
+// spoolOrLog spools the batches of alerts of the notification that could not
+// be delivered, it returns false if they are lost. The notifications rejected
+// by Rocket.Chat are not spooled as they would be rejected again.
+func spoolOrLog(profile string, data template.Data, undelivered []*channelBatch, errSend error) bool {
+	if notificationSpool == nil || classifyError(errSend) == attemptPermanentError {
+		return false
+	}
+	if errSpool := notificationSpool.add(profile, data, undelivered, errSend); errSpool != nil {
+		log.Errorf("Error spooling notification: %v", errSpool)
+		return false
+	}
+	log.Warnf("Spooled notification for later delivery after error: %v", errSend)
+	return true
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	stateBackendMemory = "memory"
+	stateBackendFile   = "file"
+
+	defaultStateTTL        = 24 * time.Hour
+	defaultStateGCInterval = 5 * time.Minute
+)
+
+// StateInfo - Alert to message state configuration
+type StateInfo struct {
+	Backend    string        `yaml:"backend"`
+	Path       string        `yaml:"path"`
+	TTL        time.Duration `yaml:"ttl"`
+	GCInterval time.Duration `yaml:"gc_interval"`
+}
+
+// ttl returns how long the message posted for an alert is remembered
+func (state StateInfo) ttl() time.Duration {
+	if state.TTL > 0 {
+		return state.TTL
+	}
+	return defaultStateTTL
+}
+
+// gcInterval returns how often the expired entries are removed
+func (state StateInfo) gcInterval() time.Duration {
+	if state.GCInterval > 0 {
+		return state.GCInterval
+	}
+	return defaultStateGCInterval
+}
+
+// StateEntry is the Rocket.Chat message posted for an alert
+type StateEntry struct {
+	MessageID string    `json:"message_id"`
+	RoomID    string    `json:"room_id"`
+	Expires   time.Time `json:"expires"`
+}
+
+// StateStore remembers the messages posted for alerts until they expire
+type StateStore interface {
+	Get(key string) (StateEntry, bool)
+	Set(key string, entry StateEntry) error
+	Delete(key string) error
+	GC() error
+	Len() int
+}
+
+var alertMessages StateStore = newMemoryStore()
+
+// newStateStore returns the store of the configured backend
+func newStateStore(state StateInfo) (StateStore, error) {
+	switch state.Backend {
+	case "", stateBackendMemory:
+		return newMemoryStore(), nil
+	case stateBackendFile:
+		return newFileStore(state.Path)
+	}
+	return nil, fmt.Errorf("unknown state backend %q", state.Backend)
+}
+
+// runStateGC periodically removes the expired entries of the store
+func runStateGC(store StateStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := store.GC(); err != nil {
+			log.Errorf("Error collecting expired state entries: %v", err)
+		}
+	}
+}
+
+// alertKey identifies an alert in a room by its label set and start time
+func alertKey(alert template.Alert, roomID string) string {
+	labelSet := make(model.LabelSet, len(alert.Labels))
+	for name, value := range alert.Labels {
+		labelSet[model.LabelName(name)] = model.LabelValue(value)
+	}
+	return fmt.Sprintf("%s/%s/%d", roomID, labelSet.Fingerprint(), alert.StartsAt.UnixNano())
+}
+
+// newStateEntry returns the entry of a message expiring after the configured TTL
+func (config Config) newStateEntry(messageID, roomID string) StateEntry {
+	return StateEntry{
+		MessageID: messageID,
+		RoomID:    roomID,
+		Expires:   time.Now().Add(config.State.ttl()),
+	}
+}
+
+// memoryStore keeps the state in memory, it is lost on restart
+type memoryStore struct {
+	mutex   sync.Mutex
+	entries map[string]StateEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: map[string]StateEntry{}}
+}
+
+// Get returns the entry stored for key, unless it expired
+func (store *memoryStore) Get(key string) (StateEntry, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entry, found := store.entries[key]
+	if found && time.Now().After(entry.Expires) {
+		return StateEntry{}, false
+	}
+	return entry, found
+}
+
+// Set stores the entry for key
+func (store *memoryStore) Set(key string, entry StateEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.entries[key] = entry
+	return nil
+}
+
+// Delete forgets the entry stored for key
+func (store *memoryStore) Delete(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.entries, key)
+	return nil
+}
+
+// GC removes the expired entries
+func (store *memoryStore) GC() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for key, entry := range store.entries {
+		if now.After(entry.Expires) {
+			delete(store.entries, key)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of entries, expired or not
+func (store *memoryStore) Len() int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return len(store.entries)
+}
+
+// stateRecord is a line of the file store log
+type stateRecord struct {
+	Key     string      `json:"key"`
+	Entry   *StateEntry `json:"entry,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+}
+
+// fileStore keeps the state in memory and in an append-only JSON log, which
+// is replayed on startup and compacted on every garbage collection
+type fileStore struct {
+	*memoryStore
+
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("state file path not provided")
+	}
+
+	store := &fileStore{memoryStore: newMemoryStore(), path: path}
+	if err := store.load(); err != nil {
+		return nil, fmt.Errorf("error loading state file %s: %v", path, err)
+	}
+	if err := store.GC(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// load replays the log into memory
+func (store *fileStore) load() error {
+	file, err := os.Open(store.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := stateRecord{}
+		if errJSON := json.Unmarshal(scanner.Bytes(), &record); errJSON != nil {
+			// A partially written last line is expected after a crash
+			log.Warnf("Skipping invalid state record in %s: %v", store.path, errJSON)
+			continue
+		}
+		if record.Deleted || record.Entry == nil {
+			store.memoryStore.Delete(record.Key)
+		} else {
+			store.memoryStore.Set(record.Key, *record.Entry)
+		}
+	}
+	return scanner.Err()
+}
+
+// append writes a record at the end of the log
+func (store *fileStore) append(record stateRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = store.file.Write(append(line, '\n'))
+	return err
+}
+
+// Set stores the entry for key
+func (store *fileStore) Set(key string, entry StateEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.memoryStore.Set(key, entry)
+	return store.append(stateRecord{Key: key, Entry: &entry})
+}
+
+// Delete forgets the entry stored for key
+func (store *fileStore) Delete(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.memoryStore.Delete(key)
+	return store.append(stateRecord{Key: key, Deleted: true})
+}
+
+// GC removes the expired entries and rewrites the log with the remaining ones
+func (store *fileStore) GC() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.memoryStore.GC()
+
+	tmpPath := store.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmpFile)
+	encoder := json.NewEncoder(writer)
+
+	store.memoryStore.mutex.Lock()
+	for key, entry := range store.memoryStore.entries {
+		entry := entry
+		if err = encoder.Encode(stateRecord{Key: key, Entry: &entry}); err != nil {
+			break
+		}
+	}
+	store.memoryStore.mutex.Unlock()
+
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if errClose := tmpFile.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, store.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error compacting state file %s: %v", store.path, err)
+	}
+
+	if store.file != nil {
+		store.file.Close()
+	}
+	store.file, err = os.OpenFile(store.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return err
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RocketChat/Rocket.Chat.Go.SDK/realtime"
+	"github.com/gopackage/ddp"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	defaultKeepaliveInterval    = 30 * time.Second
+	defaultMaxReconnectFailures = 3
+)
+
+// errReconnecting is returned when the previous reconnection of a client is
+// still in progress
+var errReconnecting = errors.New("previous reconnection still in progress")
+
+// RealtimeInfo - Realtime connection supervision configuration
+type RealtimeInfo struct {
+	KeepaliveInterval    time.Duration `yaml:"keepalive_interval"`
+	MaxReconnectFailures int           `yaml:"max_reconnect_failures"`
+}
+
+// keepaliveInterval returns how often the connection is checked
+func (info RealtimeInfo) keepaliveInterval() time.Duration {
+	if info.KeepaliveInterval > 0 {
+		return info.KeepaliveInterval
+	}
+	return defaultKeepaliveInterval
+}
+
+// maxReconnectFailures returns how many reconnections may fail in a row
+// before the client is rebuilt
+func (info RealtimeInfo) maxReconnectFailures() int {
+	if info.MaxReconnectFailures > 0 {
+		return info.MaxReconnectFailures
+	}
+	return defaultMaxReconnectFailures
+}
+
+// trackedConnection is the realtime client of a server whose state is
+// reported by the connection state metric, the clients replaced by a reload
+// are ignored
+type trackedConnection struct {
+	client *realtime.Client
+	status int
+}
+
+var (
+	trackedConnections = map[string]*trackedConnection{}
+	trackedClientMutex sync.Mutex
+)
+
+// trackConnectionState reports the state of the realtime client of the
+// server in the connection state metric. The websocket is open once the
+// client is created. The client logs in again when its connection is
+// restored, as the server does not resume the session.
+func trackConnectionState(server string, client *realtime.Client) {
+	trackedClientMutex.Lock()
+	trackedConnections[server] = &trackedConnection{client: client, status: ddp.CONNECTED}
+	trackedClientMutex.Unlock()
+	connectionState.WithLabelValues(server).Set(ddp.CONNECTED)
+
+	disconnected := false
+	client.AddStatusListener(func(status int) {
+		trackedClientMutex.Lock()
+		defer trackedClientMutex.Unlock()
+		tracked, exists := trackedConnections[server]
+		if !exists || client != tracked.client {
+			return
+		}
+		tracked.status = status
+		connectionState.WithLabelValues(server).Set(float64(status))
+
+		switch status {
+		case ddp.DISCONNECTED:
+			if !disconnected {
+				log.Warnf("Realtime connection to Rocket.Chat server %s lost", server)
+			}
+			disconnected = true
+		case ddp.CONNECTED:
+			if disconnected {
+				log.Infof("Realtime connection to Rocket.Chat server %s restored", server)
+				disconnected = false
+				// The listener runs on the goroutine reading the websocket,
+				// which the login waits for
+				go relogin(server)
+			}
+		}
+	})
+}
+
+// untrackConnection stops reporting the state of the client of a server
+// removed by a reload
+func untrackConnection(server string) {
+	trackedClientMutex.Lock()
+	defer trackedClientMutex.Unlock()
+
+	delete(trackedConnections, server)
+	connectionState.DeleteLabelValues(server)
+}
+
+// trackedConnectionStatus returns the state of the realtime client of the server
+func trackedConnectionStatus(server string) int {
+	trackedClientMutex.Lock()
+	defer trackedClientMutex.Unlock()
+
+	if tracked, exists := trackedConnections[server]; exists {
+		return tracked.status
+	}
+	return ddp.DISCONNECTED
+}
+
+// relogin authenticates the active client of the server again
+func relogin(name string) {
+	active, _ := activeConfig()
+	server, exists := active.server(name)
+	client := active.client(name)
+	if !exists || client == nil {
+		return
+	}
+	authenticateServerOrLog(server, client)
+}
+
+// realtimeServers returns the names of the servers reached through the
+// realtime API and the settings of their supervision
+func realtimeServers() ([]string, RealtimeInfo) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	var names []string
+	for _, server := range config.servers() {
+		if server.isRealtime() {
+			names = append(names, server.Name)
+		}
+	}
+	return names, config.Realtime
+}
+
+// activeRealtimeClient returns the active client of the server when it is a
+// realtime one, nil otherwise, and the timeout of its calls
+func activeRealtimeClient(name string) (*sharedClient, time.Duration) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	server, exists := config.server(name)
+	connector := serverClient(name)
+	if !exists || connector == nil {
+		return nil, 0
+	}
+	if _, ok := realtimeConnector(connector); !ok {
+		return nil, 0
+	}
+	client, ok := connector.(*sharedClient)
+	if !ok {
+		client = newSharedClient(connector, 1)
+	}
+	return client, server.timeout()
+}
+
+// rebuildRealtimeClient replaces the client of the server, which failed to
+// reconnect, with a new one. The old client is closed first, so that it stops
+// reconnecting, and the new one connects and logs in without the lock. The
+// new client is dropped if a reload replaced the old one meanwhile.
+func rebuildRealtimeClient(name string, old *sharedClient) error {
+	active, _ := activeConfig()
+	server, exists := active.server(name)
+	if !exists {
+		return fmt.Errorf("unknown server %s", name)
+	}
+	closeRocketChat(old)
+	newClient, errClient := newRocketChat(server)
+	if errClient != nil {
+		return errClient
+	}
+	authenticateServerOrLog(server, newClient)
+
+	configMutex.Lock()
+	current, stillExists := config.server(name)
+	replaced := !stillExists || !current.sameConnection(server) || serverClient(name) != RocketChat(old)
+	if !replaced {
+		swapServerClient(name, newClient)
+	}
+	configMutex.Unlock()
+
+	if replaced {
+		closeRocketChat(newClient)
+	}
+	return nil
+}
+
+// keepalive checks the session of the client is still alive
+func keepalive(client *sharedClient) (err error) {
+	connector, _ := realtimeConnector(client)
+	client.call(func() {
+		err = connector.Keepalive()
+	})
+	return err
+}
+
+// reconnect reconnects the client, waiting for its connection until the
+// timeout is over. It does not wait for the calls in progress, which may be
+// stuck on the lost connection, and does nothing while a reconnection of the
+// client is still in progress.
+func reconnect(client *sharedClient, timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&client.reconnecting, 0, 1) {
+		return errReconnecting
+	}
+	connector, _ := realtimeConnector(client)
+	done := make(chan struct{})
+	go func() {
+		defer atomic.StoreInt32(&client.reconnecting, 0)
+		connector.Client.Reconnect()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("reconnection timed out after %v", timeout)
+	}
+}
+
+// superviseRealtime keeps the realtime clients connected and authenticated
+// until stop is closed. Every interval, a connected client is sent a
+// keepalive and a disconnected one is reconnected; a client is rebuilt when
+// reconnecting it fails repeatedly.
+func superviseRealtime(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failures := map[string]int{}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		names, info := realtimeServers()
+		supervised := map[string]int{}
+		for _, name := range names {
+			supervised[name] = superviseServer(name, info, failures[name])
+		}
+		failures = supervised
+	}
+}
+
+// superviseServer checks the realtime client of the server once, given the
+// number of reconnections that failed in a row, and returns the new number
+func superviseServer(name string, info RealtimeInfo, failures int) int {
+	client, timeout := activeRealtimeClient(name)
+	if client == nil {
+		return 0
+	}
+
+	if trackedConnectionStatus(name) == ddp.CONNECTED {
+		errKeepalive := keepalive(client)
+		if errKeepalive == nil {
+			return 0
+		}
+		keepaliveFailures.WithLabelValues(name).Inc()
+		if classifyError(errKeepalive) == attemptAuthError {
+			log.Warnf("Realtime session of server %s expired, logging in again: %v", name, errKeepalive)
+			relogin(name)
+			return failures
+		}
+		log.Warnf("Realtime keepalive of server %s failed: %v", name, errKeepalive)
+	}
+
+	failures++
+	if failures > info.maxReconnectFailures() {
+		log.Warnf("Rebuilding realtime client of server %s after %d failed reconnections", name, failures-1)
+		realtimeRebuilds.WithLabelValues(name).Inc()
+		if errRebuild := rebuildRealtimeClient(name, client); errRebuild != nil {
+			// The old client is closed, the rebuild is tried again next time
+			log.Errorf("Error rebuilding realtime client of server %s: %v", name, errRebuild)
+			return failures
+		}
+		return 0
+	}
+
+	log.Warnf("Reconnecting realtime client of server %s, attempt %d", name, failures)
+	realtimeReconnects.WithLabelValues(name).Inc()
+	if errReconnect := reconnect(client, timeout); errReconnect != nil {
+		log.Warnf("Error reconnecting realtime client of server %s: %v", name, errReconnect)
+	}
+	return failures
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	tmpltext "text/template"
+
+	"github.com/prometheus/alertmanager/template"
+)
+
+const (
+	defaultTitleTemplate = `**[ {{ .Alert.Status }} ] {{ .Alert.Labels.alertname }} from {{ .Receiver }} at {{ .Alert.StartsAt }}**`
+
+	defaultGroupTitleTemplate = `**[ {{ .Status }} ] {{ .GroupLabels.SortedPairs.Values | join " " }} from {{ .Receiver }}: {{ .Alerts.Firing | len }} firing, {{ .Alerts.Resolved | len }} resolved**`
+
+	defaultAttachmentTemplate = `{{ range .Alert.Labels.SortedPairs }}**{{ .Name }}**: {{ .Value }}
+{{ end }}{{ range .Alert.Annotations.SortedPairs }}**{{ .Name }}**: {{ .Value }}
+{{ end }}`
+)
+
+// TemplatesInfo - Message templates configuration
+type TemplatesInfo struct {
+	Files      []string `yaml:"files"`
+	Title      string   `yaml:"title"`
+	GroupTitle string   `yaml:"group_title"`
+	Text       string   `yaml:"text"`
+	Attachment string   `yaml:"attachment"`
+
+	template *template.Template
+}
+
+// TemplateData is the data passed to the message templates: the whole
+// notification sent by AlertManager and the alert being formatted
+type TemplateData struct {
+	template.Data
+	Alert template.Alert
+}
+
+// loadTemplates parses the template files and validates the inline templates
+func loadTemplates(info *TemplatesInfo) error {
+	tmpl, err := template.FromGlobs(info.Files...)
+	if err != nil {
+		return fmt.Errorf("error loading template files: %v", err)
+	}
+
+	inline := []struct{ name, text string }{
+		{"title", info.Title},
+		{"group_title", info.GroupTitle},
+		{"text", info.Text},
+		{"attachment", info.Attachment},
+	}
+	for _, t := range inline {
+		_, errParse := tmpltext.New(t.name).Funcs(tmpltext.FuncMap(template.DefaultFuncs)).Parse(t.text)
+		if errParse != nil {
+			return fmt.Errorf("error parsing %s template: %v", t.name, errParse)
+		}
+	}
+
+	info.template = tmpl
+	return nil
+}
+
+// override returns the templates with the ones set in overrides taking
+// precedence, and the template files of both
+func (info TemplatesInfo) override(overrides TemplatesInfo) TemplatesInfo {
+	merged := TemplatesInfo{
+		Files:      append(append([]string{}, info.Files...), overrides.Files...),
+		Title:      info.Title,
+		GroupTitle: info.GroupTitle,
+		Text:       info.Text,
+		Attachment: info.Attachment,
+	}
+	if overrides.Title != "" {
+		merged.Title = overrides.Title
+	}
+	if overrides.GroupTitle != "" {
+		merged.GroupTitle = overrides.GroupTitle
+	}
+	if overrides.Text != "" {
+		merged.Text = overrides.Text
+	}
+	if overrides.Attachment != "" {
+		merged.Attachment = overrides.Attachment
+	}
+	return merged
+}
+
+// executeTemplate renders text, or fallback when text is empty, against data
+func (info TemplatesInfo) executeTemplate(text, fallback string, data interface{}) (string, error) {
+	if info.template == nil {
+		return "", fmt.Errorf("templates not loaded")
+	}
+	if text == "" {
+		text = fallback
+	}
+	return info.template.ExecuteTextString(text, data)
+}